@@ -0,0 +1,65 @@
+// Command mysqlfs-fsck checks the files table of mysqlfs for
+// inconsistencies and optionally repairs them.
+//
+//	mysqlfs-fsck -dsn "user:password@/db" -table files [-repair rebuild|quarantine]
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/ujent/go-git-mysql/mysqlfs"
+)
+
+func main() {
+	dsn := flag.String("dsn", "", "MySQL data source name")
+	table := flag.String("table", "", "name of the files table")
+	repair := flag.String("repair", "", "repair the table: rebuild creates missing dirs, quarantine moves orphans into "+mysqlfs.QuarantineDir)
+	flag.Parse()
+
+	if *dsn == "" || *table == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+
+	if err != nil {
+		fail(err)
+	}
+
+	defer db.Close()
+
+	var problems []mysqlfs.Problem
+
+	switch *repair {
+	case "":
+		problems, err = mysqlfs.Check(db, *table)
+	case "rebuild":
+		problems, err = mysqlfs.Repair(db, *table, mysqlfs.RepairRebuildParents)
+	case "quarantine":
+		problems, err = mysqlfs.Repair(db, *table, mysqlfs.RepairQuarantine)
+	default:
+		fail(fmt.Errorf("unknown repair mode %q", *repair))
+	}
+
+	if err != nil {
+		fail(err)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
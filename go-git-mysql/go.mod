@@ -6,7 +6,8 @@ require (
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/kr/pty v1.1.4 // indirect
-	golang.org/x/sys v0.0.0-20190520201301-c432e742b0af // indirect
+	github.com/lib/pq v1.0.0
 	gopkg.in/src-d/go-billy.v4 v4.3.0
 	gopkg.in/src-d/go-git.v4 v4.11.0
+	modernc.org/sqlite v1.18.0
 )
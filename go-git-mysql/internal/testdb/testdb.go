@@ -0,0 +1,81 @@
+// Package testdb provides the db the tests of mysqlfs and mysqlstorage run
+// on. It's an SQLite db in a temp file, set MYSQLFS_TEST_MYSQL to a MySQL
+// DSN or MYSQLFS_TEST_POSTGRES to a PostgreSQL DSN to run the tests there.
+package testdb
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	// the drivers of the dbs the tests can run on
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Drivers of the test dbs
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	// SQLite - pure Go SQLite driver, the tests don't need a db server
+	SQLite = "sqlite"
+)
+
+// DB - the db of the tests of a package
+type DB struct {
+	Driver string
+	DSN    string
+	// path - file of the SQLite db
+	path string
+}
+
+// New returns the test db, the SQLite db is kept in the temp file name
+func New(name string) DB {
+	if dsn := os.Getenv("MYSQLFS_TEST_MYSQL"); dsn != "" {
+		return DB{Driver: MySQL, DSN: dsn}
+	}
+
+	if dsn := os.Getenv("MYSQLFS_TEST_POSTGRES"); dsn != "" {
+		return DB{Driver: Postgres, DSN: dsn}
+	}
+
+	path := filepath.Join(os.TempDir(), name)
+
+	return DB{Driver: SQLite, DSN: "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)", path: path}
+}
+
+// Connect opens the db with the DSN and checks the connection
+func (db DB) Connect(dsn string) (*sql.DB, error) {
+	res, err := sql.Open(db.Driver, dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = res.Ping()
+
+	if err != nil {
+		res.Close()
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Run runs the tests, the SQLite db is removed before and after them. It
+// returns the exit code for os.Exit.
+func (db DB) Run(m *testing.M) int {
+	if db.path != "" {
+		os.Remove(db.path)
+	}
+
+	code := m.Run()
+
+	if db.path != "" {
+		os.Remove(db.path)
+	}
+
+	return code
+}
@@ -0,0 +1,711 @@
+package mysqlfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+// the tests of this file check the behavior of Mysqlfs and run on both the
+// db storage and the memory storage
+
+func forEachStorage(t *testing.T, test func(t *testing.T, fs billy.Filesystem)) {
+	t.Run("sql", func(t *testing.T) {
+		db, err := createDB(connStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs, err := New(db, tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer dropTable(connStr, tableName)
+
+		test(t, fs)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewWithStorage(NewMemoryStorage(), Options{}))
+	})
+}
+
+func TestBehaviorOpenFileFlags(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		_, err := fs.OpenFile("/dir1/file1.txt", os.O_RDWR, 0666)
+		if err != os.ErrNotExist {
+			t.Errorf("Wrong error. Must: %s, has: %v", os.ErrNotExist, err)
+		}
+
+		err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.OpenFile("/dir1/file1.txt", os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte(" world"))
+		f.Close()
+
+		content, err := readFile(fs, "/dir1/file1.txt")
+		if string(content) != "Hello world" || err != nil {
+			t.Errorf("Wrong content after append: %q, %v", content, err)
+		}
+
+		f, err = fs.OpenFile("/dir1/file1.txt", os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+
+		fi, err := fs.Stat("/dir1/file1.txt")
+		if err != nil || fi.Size() != 0 {
+			t.Errorf("File wasn't truncated: %v, %v", fi, err)
+		}
+
+		_, err = fs.OpenFile("/dir1", os.O_RDONLY, 0)
+		if err == nil {
+			t.Error("Dir was opened as a file")
+		}
+	})
+}
+
+func TestBehaviorReadAt(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/file1.txt", []byte("Hello world"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.Open("/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		p := make([]byte, 8)
+		n, err := f.ReadAt(p, 6)
+		if n != 5 || err != io.EOF || string(p[:n]) != "world" {
+			t.Errorf("Wrong ReadAt: %d, %v, %q", n, err, p[:n])
+		}
+
+		_, err = f.ReadAt(p, 11)
+		if err != io.EOF {
+			t.Errorf("Wrong error. Must: %s, has: %v", io.EOF, err)
+		}
+	})
+}
+
+func TestBehaviorWriteAt(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/file1.txt", []byte("Hello world"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mfs, _ := Unwrap(fs)
+
+		f, err := mfs.OpenFile("/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var w io.WriterAt = f.(*File)
+
+		n, err := w.WriteAt([]byte("there"), 6)
+		if n != 5 || err != nil {
+			t.Errorf("Wrong WriteAt: %d, %v", n, err)
+		}
+
+		n, err = w.WriteAt([]byte("!"), 13)
+		if n != 1 || err != nil {
+			t.Errorf("Wrong WriteAt: %d, %v", n, err)
+		}
+
+		// the position isn't moved by WriteAt
+		f.Write([]byte("J"))
+		f.Close()
+
+		content, err := readFile(fs, "/file1.txt")
+		if string(content) != "Jello there\x00\x00!" || err != nil {
+			t.Errorf("Wrong content after WriteAt: %q, %v", content, err)
+		}
+	})
+}
+
+func TestBehaviorSymlink(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Symlink("file1.txt", "/dir1/link1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target, err := fs.Readlink("/dir1/link1")
+		if target != "file1.txt" || err != nil {
+			t.Errorf("Wrong link target: %q, %v", target, err)
+		}
+
+		fi, err := fs.Stat("/dir1/link1")
+		if err != nil || fi.Name() != "link1" || fi.Size() != 5 {
+			t.Errorf("Wrong stat of link: %v, %v", fi, err)
+		}
+
+		fi, err = fs.Lstat("/dir1/link1")
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Wrong lstat of link: %v, %v", fi, err)
+		}
+
+		content, err := readFile(fs, "/dir1/link1")
+		if string(content) != "Hello" || err != nil {
+			t.Errorf("Wrong content read through link: %q, %v", content, err)
+		}
+	})
+}
+
+func TestBehaviorDuplicate(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mfs, _ := Unwrap(fs)
+
+		f, err := mfs.Open("/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := f.(*File).Duplicate(0666, os.O_WRONLY|os.O_APPEND)
+		d.Write([]byte("!"))
+
+		err = d.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		f.Close()
+
+		content, err := readFile(fs, "/file1.txt")
+		if string(content) != "Hello!" || err != nil {
+			t.Errorf("Wrong content after write to duplicate: %q, %v", content, err)
+		}
+
+		f, err = mfs.Open("/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		// the truncation is seen before the duplicate writes or is closed
+		d = f.(*File).Duplicate(0666, os.O_WRONLY|os.O_TRUNC)
+		defer d.Close()
+
+		content, err = readFile(fs, "/file1.txt")
+		if len(content) != 0 || err != nil {
+			t.Errorf("Duplicate wasn't truncated: %q, %v", content, err)
+		}
+	})
+}
+
+func TestBehaviorParentIDs(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/dir1/dir2/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = util.WriteFile(fs, "/dir1/file2.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := unwrapStorage(t, fs)
+
+		dir1, _ := s.GetFile("/dir1")
+		dir2, _ := s.GetFile("/dir1/dir2")
+		file1, _ := s.GetFile("/dir1/dir2/file1.txt")
+
+		if dir1 == nil || dir2 == nil || file1 == nil {
+			t.Fatalf("Files weren't created: %v, %v, %v", dir1, dir2, file1)
+		}
+
+		if dir1.ParentID != 0 || dir2.ParentID != dir1.ID || file1.ParentID != dir2.ID {
+			t.Errorf("Wrong parent ids: %d, %d, %d", dir1.ParentID, dir2.ParentID, file1.ParentID)
+		}
+
+		ids, err := s.ChildrenIdsByFileID(dir1.ID)
+		if err != nil || len(ids) != 2 || ids[0] != dir2.ID {
+			t.Errorf("Wrong children of dir1: %v, %v", ids, err)
+		}
+
+		root, err := s.Children("/")
+		if err != nil || len(root) != 1 || root[0].ID != dir1.ID {
+			t.Errorf("Wrong children of root: %v, %v", root, err)
+		}
+
+		infos, err := fs.ReadDir("/dir1")
+		if err != nil || len(infos) != 2 {
+			t.Errorf("Wrong ReadDir: %v, %v", infos, err)
+		}
+
+		infos, err = fs.ReadDir("/dir3")
+		if err != nil || len(infos) != 0 {
+			t.Errorf("Wrong ReadDir of missing dir: %v, %v", infos, err)
+		}
+	})
+}
+
+func TestBehaviorRename(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/dir1/dir2/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = util.WriteFile(fs, "/file2.txt", []byte("Hi"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Rename("/dir1", "/dir1/dir2/dir3")
+		if err == nil {
+			t.Error("Dir was renamed into its descendant")
+		}
+
+		err = fs.Rename("/dir1", "/file2.txt")
+		if err == nil {
+			t.Error("File was replaced with dir")
+		}
+
+		err = fs.Rename("/file2.txt", "/dir1")
+		if err == nil {
+			t.Error("Dir was replaced with file")
+		}
+
+		err = fs.Rename("/dir1", "/dir4/dir5")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := unwrapStorage(t, fs)
+
+		dir5, _ := s.GetFile("/dir4/dir5")
+		dir2, _ := s.GetFile("/dir4/dir5/dir2")
+		file1, _ := s.GetFile("/dir4/dir5/dir2/file1.txt")
+		old, _ := s.GetFile("/dir1/dir2/file1.txt")
+
+		if dir5 == nil || dir2 == nil || file1 == nil || old != nil {
+			t.Fatalf("Subtree wasn't moved: %v, %v, %v, %v", dir5, dir2, file1, old)
+		}
+
+		dir4, _ := s.GetFile("/dir4")
+		if dir5.ParentID != dir4.ID || dir2.ParentID != dir5.ID {
+			t.Errorf("Wrong parent ids after rename: %d, %d", dir5.ParentID, dir2.ParentID)
+		}
+
+		err = fs.Rename("/file2.txt", "/dir4/dir5/dir2/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := readFile(fs, "/dir4/dir5/dir2/file1.txt")
+		if string(content) != "Hi" || err != nil {
+			t.Errorf("File wasn't replaced: %q, %v", content, err)
+		}
+
+		// an open file doesn't read the size of the file which took its path
+		f, err := fs.Open("/dir4/dir5/dir2/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Rename("/dir4/dir5/dir2/file1.txt", "/file3.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = util.WriteFile(fs, "/dir4/dir5/dir2/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err = ioutil.ReadAll(f)
+		if string(content) != "Hi" || err != nil {
+			t.Errorf("Wrong content of renamed file: %q, %v", content, err)
+		}
+
+		f.Close()
+	})
+}
+
+func TestBehaviorRemove(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Remove("/dir2")
+		if err != os.ErrNotExist {
+			t.Errorf("Wrong error. Must: %s, has: %v", os.ErrNotExist, err)
+		}
+
+		err = fs.Remove("/dir1")
+		if err == nil {
+			t.Error("Not empty dir was removed")
+		}
+
+		err = fs.Remove("/dir1/file1.txt")
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = fs.Remove("/dir1")
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = fs.Stat("/dir1")
+		if err != os.ErrNotExist {
+			t.Errorf("Wrong error. Must: %s, has: %v", os.ErrNotExist, err)
+		}
+	})
+}
+
+func TestBehaviorConcurrentModification(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mfs, _ := Unwrap(fs)
+
+		f, err := mfs.OpenFile("/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := f.(*File).Duplicate(0666, os.O_RDWR)
+
+		f.Write([]byte("Hi"))
+		d.Write([]byte("Yo"))
+
+		err = f.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = d.Close()
+		if err != ErrConcurrentModification {
+			t.Errorf("Wrong error. Must: %s, has: %v", ErrConcurrentModification, err)
+		}
+
+		content, err := readFile(fs, "/file1.txt")
+		if string(content) != "Hillo" || err != nil {
+			t.Errorf("Lost update: %q, %v", content, err)
+		}
+
+		// a file writing several times sees its own changes
+		f, err = mfs.OpenFile("/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("He"))
+
+		err = f.(*File).Sync()
+		if err != nil {
+			t.Error(err)
+		}
+
+		f.Write([]byte("y"))
+
+		err = f.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		// renames and metadata changes don't conflict with buffered writes
+		f, err = mfs.OpenFile("/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("Ja"))
+
+		err = fs.Rename("/file1.txt", "/file2.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = mfs.Chmod("/file2.txt", 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.(*File).Sync()
+		if err != nil {
+			t.Error(err)
+		}
+
+		f.Write([]byte("y"))
+
+		err = f.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		content, err = readFile(fs, "/file2.txt")
+		if string(content) != "Jaylo" || err != nil {
+			t.Errorf("Wrong content: %q, %v", content, err)
+		}
+
+		err = fs.Rename("/file2.txt", "/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the holder of the lock may write the changes made before it
+		f, err = fs.OpenFile("/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.Lock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("J"))
+
+		err = f.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		content, err = readFile(fs, "/file1.txt")
+		if string(content) != "Jello" || err != nil {
+			t.Errorf("Wrong content: %q, %v", content, err)
+		}
+	})
+}
+
+func TestBehaviorContext(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mfs, _ := Unwrap(fs)
+		ctx, cancel := context.WithCancel(context.Background())
+		cfs := mfs.WithContext(ctx)
+
+		f, err := cfs.Open("/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+
+		_, err = ioutil.ReadAll(f)
+		if err != ErrCanceled {
+			t.Errorf("Wrong error. Must: %s, has: %v", ErrCanceled, err)
+		}
+
+		_, err = cfs.Stat("/file1.txt")
+		if err != ErrCanceled {
+			t.Errorf("Wrong error. Must: %s, has: %v", ErrCanceled, err)
+		}
+
+		err = util.WriteFile(cfs, "/file2.txt", []byte("Hello"), 0666)
+		if err != ErrCanceled {
+			t.Errorf("Wrong error. Must: %s, has: %v", ErrCanceled, err)
+		}
+
+		_, err = fs.Stat("/file1.txt")
+		if err != nil {
+			t.Errorf("Filesystem without context failed: %s", err)
+		}
+	})
+}
+
+func TestBehaviorTx(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		mfs, _ := Unwrap(fs)
+		errRollback := errors.New("rollback")
+
+		err := util.WriteFile(fs, "/keep.txt", []byte("Keep"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = mfs.Tx(func(fs billy.Filesystem) error {
+			err := util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello"), 0666)
+			if err != nil {
+				return err
+			}
+
+			err = util.WriteFile(fs, "/keep.txt", []byte("Changed"), 0666)
+			if err != nil {
+				return err
+			}
+
+			err = fs.Rename("/keep.txt", "/dir1/moved.txt")
+			if err != nil {
+				return err
+			}
+
+			return errRollback
+		})
+
+		if err != errRollback {
+			t.Errorf("Wrong error. Must: %s, has: %v", errRollback, err)
+		}
+
+		_, err = fs.Stat("/dir1")
+		if err != os.ErrNotExist {
+			t.Errorf("Rolled back dir exists: %v", err)
+		}
+
+		content, err := readFile(fs, "/keep.txt")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(content) != "Keep" {
+			t.Errorf("Wrong content after rollback. Must: Keep, has: %s", content)
+		}
+	})
+}
+
+func unwrapStorage(t *testing.T, fs billy.Filesystem) Storage {
+	mfs, ok := Unwrap(fs)
+	if !ok {
+		t.Fatal("Not a Mysqlfs")
+	}
+
+	return mfs.storage
+}
+
+func TestBehaviorObserver(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		events := []Event{}
+
+		mfs, _ := Unwrap(fs)
+		mfs.options.Observer = ObserverFunc(func(e Event) { events = append(events, e) })
+
+		err := fs.Symlink("/dir1/file1.txt", "/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.Create("/dir1/file1.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("Hello"))
+		f.Close()
+
+		// the operations run by Symlink are part of its event
+		ops := []string{}
+		for _, e := range events {
+			ops = append(ops, e.Op)
+		}
+
+		if strings.Join(ops, ",") != "Symlink,OpenFile,Write,Close" {
+			t.Errorf("Wrong events: %v", ops)
+		}
+
+		if events[3].Bytes != 5 || events[3].Err != nil || events[3].Path != "/dir1/file1.txt" {
+			t.Errorf("Wrong event of Close: %+v", events[3])
+		}
+
+		events = nil
+
+		_, err = fs.Stat("/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(events) != 1 || events[0].Op != "Stat" || events[0].Path != "/link" {
+			t.Errorf("Wrong events of Stat: %+v", events)
+		}
+	})
+}
+
+func TestBehaviorTruncate(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, fs billy.Filesystem) {
+		err := util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello world"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.OpenFile("/dir1/file1.txt", os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		// the new size is saved right away, without a later write or Close
+		err = f.Truncate(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := readFile(fs, "/dir1/file1.txt")
+		if string(content) != "Hello" || err != nil {
+			t.Errorf("Wrong content after truncation: %q, %v", content, err)
+		}
+
+		err = f.Truncate(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err = readFile(fs, "/dir1/file1.txt")
+		if string(content) != "Hello\x00\x00\x00" || err != nil {
+			t.Errorf("Wrong content after growing: %q, %v", content, err)
+		}
+
+		f1, err := fs.OpenFile("/dir1/file1.txt", os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f1.Close()
+
+		fi, err := fs.Stat("/dir1/file1.txt")
+		if err != nil || fi.Size() != 0 {
+			t.Errorf("O_TRUNC wasn't saved: %v, %v", fi, err)
+		}
+	})
+}
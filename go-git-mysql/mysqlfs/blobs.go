@@ -0,0 +1,169 @@
+package mysqlfs
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrMissingBlob - a chunk references a blob which isn't in the table
+var ErrMissingBlob = errors.New("mysqlfs: content blob is missing")
+
+// hashChunk returns the hex SHA-256 of the saved data of a chunk
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// storedChunkDB - saved data of a chunk, or the hash of the blob holding it
+type storedChunkDB struct {
+	ChunkIndex int64          `db:"chunkIndex"`
+	Data       []byte         `db:"data"`
+	Hash       sql.NullString `db:"hash"`
+}
+
+// storedChunk returns the saved data of the chunk, suffix is appended to
+// the query, e.g. to lock the row
+func (s *storage) storedChunk(fileID, chunkIndex int64, suffix string) ([]byte, error) {
+	c := storedChunkDB{}
+
+	err := s.get(&c, fmt.Sprintf("SELECT data, hash FROM %s WHERE fileID=? AND chunkIndex=?%s", s.chunkTableName, suffix), fileID, chunkIndex)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blobData(&c)
+}
+
+// blobData returns the saved data of the chunk, which is read from its blob
+// if the chunk references one. The blobs table exists only if some chunk
+// references a blob, so it isn't joined with the chunks.
+func (s *storage) blobData(c *storedChunkDB) ([]byte, error) {
+	if c.Data != nil || !c.Hash.Valid {
+		return c.Data, nil
+	}
+
+	data := []byte{}
+
+	err := s.get(&data, fmt.Sprintf("SELECT data FROM %s WHERE hash=?", s.blobTableName), c.Hash.String)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrMissingBlob
+	}
+
+	return data, err
+}
+
+// putChunk saves the encoded data as the chunk, replacing the existing one.
+// With dedup the chunk references the blob of the data, otherwise the data
+// is kept in the chunk. References of the replaced chunk must be released
+// before.
+func (s *storage) putChunk(fileID, chunkIndex int64, data []byte) error {
+	if !s.dedup {
+		_, err := s.exec(
+			s.dialect.Upsert(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, data, hash) VALUES(?,?,?,NULL)", s.chunkTableName),
+				[]string{"fileID", "chunkIndex"}, []string{"data", "hash"}),
+			fileID, chunkIndex, data)
+
+		return err
+	}
+
+	hash := hashChunk(data)
+
+	err := s.refBlob(hash, data)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(
+		s.dialect.Upsert(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, data, hash) VALUES(?,?,NULL,?)", s.chunkTableName),
+			[]string{"fileID", "chunkIndex"}, []string{"data", "hash"}),
+		fileID, chunkIndex, hash)
+
+	return err
+}
+
+// refBlob adds a reference to the blob of the data, the blob is created if
+// it doesn't exist. A concurrent CollectBlobs either waits for the
+// transaction or removes the row before, which is then created again.
+func (s *storage) refBlob(hash string, data []byte) error {
+	_, err := s.exec(s.dialect.UpsertAdd(fmt.Sprintf("INSERT INTO %s(hash, data, refs) VALUES(?,?,1)", s.blobTableName), s.blobTableName, []string{"hash"}, "refs"),
+		hash, data)
+
+	return err
+}
+
+// copyBlobRef saves the chunk as a reference to the existing blob
+func (s *storage) copyBlobRef(fileID, chunkIndex int64, hash string) error {
+	r, err := s.exec(fmt.Sprintf("UPDATE %s SET refs=refs+1 WHERE hash=?", s.blobTableName), hash)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrMissingBlob
+	}
+
+	_, err = s.exec(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, hash) VALUES(?,?,?)", s.chunkTableName), fileID, chunkIndex, hash)
+
+	return err
+}
+
+// releaseBlobs removes the references of the chunks matching the condition
+// from their blobs. The blobs left without references are removed by
+// CollectBlobs.
+func (s *storage) releaseBlobs(where string, args ...interface{}) error {
+	// without references the blobs table isn't touched, it may not exist
+	refs := []int{}
+
+	err := s.sel(&refs, fmt.Sprintf("SELECT 1 FROM %s c WHERE c.data IS NULL AND c.hash IS NOT NULL AND %s LIMIT 1", s.chunkTableName, where), args...)
+
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+
+	_, err = s.exec(fmt.Sprintf("UPDATE %s SET refs=refs-(SELECT COUNT(*) FROM %s c WHERE c.data IS NULL AND c.hash=%s.hash AND %s) "+
+		"WHERE hash IN (SELECT c.hash FROM %s c WHERE c.data IS NULL AND %s)", s.blobTableName, s.chunkTableName, s.blobTableName, where, s.chunkTableName, where),
+		append(args, args...)...)
+
+	return err
+}
+
+// CollectBlobs removes the blobs of the table folderName which aren't
+// referenced by any chunk or snapshot and returns their number. It can run
+// alongside writers.
+func CollectBlobs(db *sql.DB, folderName string) (int64, error) {
+	s, err := openExisting(db, folderName, Options{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer s.Close()
+
+	exists, err := s.hasTable("_blobs")
+
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	r, err := s.exec(fmt.Sprintf("DELETE FROM %s WHERE refs<=0", s.blobTableName))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return r.RowsAffected()
+}
@@ -0,0 +1,123 @@
+package mysqlfs
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// fileColumns - metadata columns of the files table, files are always read
+// by this list, so the queries don't depend on the columns added later
+const fileColumns = "id, namespace, parentID, name, path, size, flag, mode, mtime, ctime, uid, gid, version, content_version"
+
+// fileCache - rows of the files table by path, the least recently used rows
+// are evicted when the cache is full. A cached row is used only if the id
+// and the version of the row in db are the same, every change of a row
+// increments its version, so changes made by other processes are never
+// missed.
+type fileCache struct {
+	sync.Mutex
+	size  int
+	order *list.List
+	m     map[string]*list.Element
+}
+
+func newFileCache(size int) *fileCache {
+	return &fileCache{size: size, order: list.New(), m: map[string]*list.Element{}}
+}
+
+func (c *fileCache) get(path string, id, version int64) (FileDB, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.m[path]
+
+	if !ok {
+		return FileDB{}, false
+	}
+
+	f := e.Value.(FileDB)
+
+	if f.ID != id || f.Version != version {
+		c.order.Remove(e)
+		delete(c.m, path)
+
+		return FileDB{}, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return f, true
+}
+
+func (c *fileCache) has(path string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.m[path]
+
+	return ok
+}
+
+func (c *fileCache) put(f FileDB) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.m[f.Path]; ok {
+		e.Value = f
+		c.order.MoveToFront(e)
+
+		return
+	}
+
+	c.m[f.Path] = c.order.PushFront(f)
+
+	if c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.m, e.Value.(FileDB).Path)
+	}
+}
+
+// getCachedFile reads the row of the path through the cache, a cached row
+// is checked by selecting only its id and version. It's used only outside
+// of transactions, rows read in a transaction may be rolled back.
+func (s *storage) getCachedFile(path string) (*FileDB, error) {
+	if s.cache.has(path) {
+		v := struct {
+			ID      int64 `db:"id"`
+			Version int64 `db:"version"`
+		}{}
+
+		err := s.get(&v, fmt.Sprintf("SELECT id, version FROM %s WHERE path=? AND namespace=? AND deleted_at IS NULL", s.fileTableName), path, s.namespace)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		if f, ok := s.cache.get(path, v.ID, v.Version); ok {
+			return &f, nil
+		}
+	}
+
+	f := FileDB{}
+
+	err := s.get(&f, fmt.Sprintf("SELECT %s FROM %s WHERE path=? AND namespace=? AND deleted_at IS NULL", fileColumns, s.fileTableName), path, s.namespace)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	s.cache.put(f)
+
+	return &f, nil
+}
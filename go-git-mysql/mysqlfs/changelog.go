@@ -0,0 +1,342 @@
+package mysqlfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Operations of changes
+const (
+	ChangeCreate = "create"
+	ChangeWrite  = "write"
+	ChangeRename = "rename"
+	ChangeRemove = "remove"
+	// ChangeRestore - all the files of the namespace were replaced by a
+	// snapshot, its path is the root
+	ChangeRestore = "restore"
+)
+
+// DefaultWatchInterval - pause between the polls of a Watcher which has
+// received all the changes
+const DefaultWatchInterval = time.Second
+
+// watchBatchSize - maximum number of changes fetched by one poll
+const watchBatchSize = 1000
+
+// ErrChangesTrimmed - changes after the cursor were removed by TrimChanges,
+// the reader has to resync with the current files
+var ErrChangesTrimmed = errors.New("mysqlfs: changes after the cursor were trimmed")
+
+// ErrInvalidLimit - the limit of Changes isn't positive
+var ErrInvalidLimit = errors.New("mysqlfs: limit must be positive")
+
+// ErrChangelogUnsupported - the storage of the filesystem has no changelog
+var ErrChangelogUnsupported = errors.New("mysqlfs: changelog isn't supported by the storage")
+
+// Change - a change of the files of a namespace, recorded with
+// Options.Changelog
+type Change struct {
+	// Seq - number of the change in the namespace, the changes of a
+	// namespace are numbered from 1 without gaps in the order of their
+	// commits
+	Seq  int64  `db:"seq"`
+	Op   string `db:"op"`
+	Path string `db:"path"`
+	// From - previous path of a renamed file
+	From string `db:"fromPath"`
+	// Time - unix time of the change in nanoseconds
+	Time int64 `db:"created"`
+}
+
+// recordChange adds the change to the changelog of the namespace. The
+// sequence of the namespace stays locked until the transaction ends, so the
+// changes are committed in the order of their numbers.
+func (s *storage) recordChange(op, path, from string) error {
+	if !s.changelog {
+		return nil
+	}
+
+	r, err := s.exec(fmt.Sprintf("UPDATE %s SET seq=seq+1 WHERE name=?", s.namespaceTableName), s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 && s.namespace == "" {
+		// the default namespace gets its row with its first change
+		err = s.registerNamespace("")
+
+		if err != nil {
+			return err
+		}
+
+		return s.recordChange(op, path, from)
+	}
+
+	if n == 0 {
+		return ErrNamespaceNotFound
+	}
+
+	seq := int64(0)
+
+	err = s.get(&seq, fmt.Sprintf("SELECT seq FROM %s WHERE name=?", s.namespaceTableName), s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(fmt.Sprintf("INSERT INTO %s(namespace, seq, op, path, fromPath, created) VALUES(?,?,?,?,?,?)", s.changeTableName),
+		s.namespace, seq, op, path, from, time.Now().UnixNano())
+
+	return err
+}
+
+// recordWrite adds the write of the content of the file to the changelog
+func (s *storage) recordWrite(fileID int64) error {
+	if !s.changelog {
+		return nil
+	}
+
+	path := ""
+
+	err := s.get(&path, fmt.Sprintf("SELECT path FROM %s WHERE id=? AND namespace=?", s.fileTableName), fileID, s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	return s.recordChange(ChangeWrite, path, "")
+}
+
+// Changes returns up to limit changes of the namespace after the cursor
+// fromSeq, which are under pathPrefix or were renamed from there, and the
+// cursor to read the next changes from. The cursor moves past the changes
+// which don't match the prefix too. Zero cursor reads from the beginning.
+// The limit must be positive, ErrInvalidLimit is returned otherwise.
+func (fs *Mysqlfs) Changes(pathPrefix string, fromSeq int64, limit int) ([]Change, int64, error) {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return nil, 0, ErrChangelogUnsupported
+	}
+
+	err := s.ensureTables(changeTables...)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return s.changes(pathPrefix, fromSeq, limit)
+}
+
+func (s *storage) changes(pathPrefix string, fromSeq int64, limit int) ([]Change, int64, error) {
+	if limit <= 0 {
+		return nil, 0, ErrInvalidLimit
+	}
+
+	// changes up to the current sequence are committed
+	head := int64(0)
+
+	err := s.get(&head, fmt.Sprintf("SELECT seq FROM %s WHERE name=?", s.namespaceTableName), s.namespace)
+
+	if err == sql.ErrNoRows {
+		// the default namespace has no row before its first change
+		if s.namespace != "" {
+			return nil, 0, ErrNamespaceNotFound
+		}
+
+		err = nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if head <= fromSeq {
+		return nil, fromSeq, nil
+	}
+
+	// the changes have no gaps, so a missing next change was trimmed
+	next := int64(0)
+
+	err = s.get(&next, fmt.Sprintf("SELECT COALESCE(MIN(seq), 0) FROM %s WHERE namespace=? AND seq>?", s.changeTableName), s.namespace, fromSeq)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if next != fromSeq+1 {
+		return nil, 0, ErrChangesTrimmed
+	}
+
+	query := fmt.Sprintf("SELECT seq, op, path, fromPath, created FROM %s WHERE namespace=? AND seq>? AND seq<=?", s.changeTableName)
+	args := []interface{}{s.namespace, fromSeq, head}
+
+	if prefix := cleanPrefix(pathPrefix); prefix != string(separator) {
+		pattern := escapeLike(prefix+string(separator)) + "%"
+		cond := "op=? OR path=? OR path LIKE ? ESCAPE '!' OR fromPath=? OR fromPath LIKE ? ESCAPE '!'"
+		args = append(args, ChangeRestore, prefix, pattern, prefix, pattern)
+
+		// renames of the dirs above the prefix move the files under it. The
+		// dirs are matched by one condition, so the query has the same
+		// arguments at any depth and its statement is reused. fromPath of
+		// the changes other than renames is empty.
+		for _, column := range []string{"path", "fromPath"} {
+			cond += fmt.Sprintf(" OR (%s<>'' AND %s=%s)", column,
+				s.dialect.Substring(s.dialect.Text("?"), "1", s.dialect.CharLength(column)+"+1"), s.dialect.Concat(column, fmt.Sprintf("'%c'", separator)))
+			args = append(args, prefix)
+		}
+
+		query += " AND (" + cond + ")"
+	}
+
+	res := []Change{}
+
+	err = s.sel(&res, query+" ORDER BY seq LIMIT ?", append(args, limit)...)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(res) == limit {
+		return res, res[len(res)-1].Seq, nil
+	}
+
+	return res, head, nil
+}
+
+// cleanPrefix returns the prefix as an absolute path, the paths of the
+// files are absolute
+func cleanPrefix(prefix string) string {
+	return clean(string(separator) + filepath.FromSlash(prefix))
+}
+
+// Watcher - stream of the changes of a namespace started by Mysqlfs.Watch
+type Watcher struct {
+	// seq is first to be aligned for atomic access
+	seq int64
+	c   chan Change
+	err error
+}
+
+// Watch streams the changes of the namespace after the cursor fromSeq,
+// which are under pathPrefix, by polling the changelog every
+// Options.WatchInterval. The changes are streamed until ctx is done or a
+// query fails.
+func (fs *Mysqlfs) Watch(ctx context.Context, pathPrefix string, fromSeq int64) (*Watcher, error) {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return nil, ErrChangelogUnsupported
+	}
+
+	err := s.ensureTables(changeTables...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{c: make(chan Change), seq: fromSeq}
+
+	go w.run(ctx, s.WithContext(ctx).(*storage), pathPrefix, fs.options.watchInterval())
+
+	return w, nil
+}
+
+// Changes returns the channel of the changes, it's closed when the watcher
+// stops
+func (w *Watcher) Changes() <-chan Change {
+	return w.c
+}
+
+// Seq returns the cursor after the changes received from the channel, the
+// watch is resumed from it by passing it to Watch
+func (w *Watcher) Seq() int64 {
+	return atomic.LoadInt64(&w.seq)
+}
+
+// Err returns the error which stopped the watcher after the channel is
+// closed: ErrCanceled after ctx is done, ErrChangesTrimmed if the cursor is
+// older than the changelog or the error of a query
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+func (w *Watcher) run(ctx context.Context, s *storage, pathPrefix string, interval time.Duration) {
+	defer close(w.c)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		changes, seq, err := s.changes(pathPrefix, w.Seq(), watchBatchSize)
+
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		for _, c := range changes {
+			select {
+			case w.c <- c:
+				atomic.StoreInt64(&w.seq, c.Seq)
+			case <-ctx.Done():
+				w.err = ErrCanceled
+				return
+			}
+		}
+
+		atomic.StoreInt64(&w.seq, seq)
+
+		// a full batch means more changes are waiting
+		if len(changes) == watchBatchSize {
+			continue
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			w.err = ErrCanceled
+			return
+		}
+	}
+}
+
+// TrimChanges removes the changes recorded longer than retention ago from
+// the changelogs of all the namespaces of the table folderName and returns
+// their number. Watchers behind the trimmed changes fail with
+// ErrChangesTrimmed.
+func TrimChanges(db *sql.DB, folderName string, retention time.Duration) (int64, error) {
+	s, err := openExisting(db, folderName, Options{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer s.Close()
+
+	exists, err := s.hasTable("_changes")
+
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	r, err := s.exec(fmt.Sprintf("DELETE FROM %s WHERE created<?", s.changeTableName), time.Now().Add(-retention).UnixNano())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return r.RowsAffected()
+}
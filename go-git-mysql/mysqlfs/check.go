@@ -0,0 +1,306 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProblemKind - kind of an inconsistency of the files table
+type ProblemKind int
+
+const (
+	// ProblemDanglingParent - parentID points at a row which doesn't exist
+	ProblemDanglingParent ProblemKind = iota + 1
+	// ProblemPathMismatch - path isn't the path of the parent joined with
+	// the name
+	ProblemPathMismatch
+	// ProblemMissingDir - there is no row for the dir of the path
+	ProblemMissingDir
+	// ProblemRootWithParent - a file at root has a parent
+	ProblemRootWithParent
+	// ProblemParentNotDir - the row of the dir of the path isn't a dir
+	ProblemParentNotDir
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemDanglingParent:
+		return "parent doesn't exist"
+	case ProblemPathMismatch:
+		return "path doesn't match parent and name"
+	case ProblemMissingDir:
+		return "dir doesn't exist"
+	case ProblemRootWithParent:
+		return "file at root has parent"
+	case ProblemParentNotDir:
+		return "parent isn't dir"
+	}
+
+	return fmt.Sprintf("problem %d", int(k))
+}
+
+// Problem - an inconsistency of a row of the files table
+type Problem struct {
+	Kind      ProblemKind
+	Namespace string
+	FileID    int64
+	Path      string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("namespace %q, file %d %q: %s", p.Namespace, p.FileID, p.Path, p.Kind)
+}
+
+// RepairMode - how Repair fixes the files whose dir doesn't exist
+type RepairMode int
+
+const (
+	// RepairRebuildParents creates the missing dirs
+	RepairRebuildParents RepairMode = iota
+	// RepairQuarantine moves the files with their subtrees into
+	// QuarantineDir
+	RepairQuarantine
+)
+
+// QuarantineDir - dir the orphaned files are moved into by Repair
+const QuarantineDir = string(separator) + "lost+found"
+
+// Check looks for inconsistencies in all the namespaces of the table
+// folderName: parent links which don't match the paths, files at root with
+// a parent and files whose dir doesn't exist. The table isn't changed.
+func Check(db *sql.DB, folderName string) ([]Problem, error) {
+	s, err := openExisting(db, folderName, Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+
+	files := []FileDB{}
+
+	err = s.sel(&files, fmt.Sprintf("SELECT %s FROM %s WHERE deleted_at IS NULL ORDER BY namespace", fileColumns, s.fileTableName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Problem{}
+
+	for start := 0; start < len(files); {
+		end := start
+		for end < len(files) && files[end].Namespace == files[start].Namespace {
+			end++
+		}
+
+		res = append(res, checkFiles(files[start:end])...)
+		start = end
+	}
+
+	return res, nil
+}
+
+// checkFiles returns the problems of the files of one namespace
+func checkFiles(files []FileDB) []Problem {
+	byID := make(map[int64]*FileDB, len(files))
+	byPath := make(map[string]*FileDB, len(files))
+
+	for i := range files {
+		byID[files[i].ID] = &files[i]
+		byPath[files[i].Path] = &files[i]
+	}
+
+	res := []Problem{}
+
+	for _, f := range files {
+		add := func(kind ProblemKind) {
+			res = append(res, Problem{Kind: kind, Namespace: f.Namespace, FileID: f.ID, Path: f.Path})
+		}
+
+		dir := filepath.Dir(f.Path)
+
+		if isRoot(dir) {
+			if f.ParentID.Valid {
+				add(ProblemRootWithParent)
+			}
+		} else if d, ok := byPath[dir]; !ok {
+			add(ProblemMissingDir)
+		} else if !os.FileMode(d.Mode).IsDir() {
+			add(ProblemParentNotDir)
+		}
+
+		if !f.ParentID.Valid {
+			if !isRoot(dir) || f.Name != filepath.Base(f.Path) {
+				add(ProblemPathMismatch)
+			}
+
+			continue
+		}
+
+		p, ok := byID[f.ParentID.Int64]
+
+		if !ok {
+			add(ProblemDanglingParent)
+			continue
+		}
+
+		if !isRoot(dir) && filepath.Join(p.Path, f.Name) != f.Path {
+			add(ProblemPathMismatch)
+		}
+	}
+
+	return res
+}
+
+// Repair fixes the problems found by Check, each namespace in its own
+// transaction. Paths are trusted: parent links and names are rebuilt from
+// them. The files whose dir doesn't exist or isn't a dir are handled by
+// the mode. The problems left after the repair are returned.
+func Repair(db *sql.DB, folderName string, mode RepairMode) ([]Problem, error) {
+	problems, err := Check(db, folderName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := map[string]bool{}
+
+	for _, p := range problems {
+		if done[p.Namespace] {
+			continue
+		}
+
+		done[p.Namespace] = true
+
+		s, err := openExisting(db, folderName, Options{Namespace: p.Namespace})
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.withTx(func(s *storage) error {
+			return s.repair(mode)
+		})
+		s.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return Check(db, folderName)
+}
+
+// repair fixes the files of the namespace of s
+func (s *storage) repair(mode RepairMode) error {
+	files, err := s.filesByDepth()
+
+	if err != nil {
+		return err
+	}
+
+	if mode == RepairQuarantine {
+		byPath := make(map[string]*FileDB, len(files))
+
+		for i := range files {
+			byPath[files[i].Path] = &files[i]
+		}
+
+		moved := false
+
+		for _, f := range files {
+			dir := filepath.Dir(f.Path)
+
+			if isRoot(dir) {
+				continue
+			}
+
+			// the subtree of a moved file is moved with it, its dir exists
+			if d, ok := byPath[dir]; ok && os.FileMode(d.Mode).IsDir() {
+				continue
+			}
+
+			if !moved {
+				_, err = s.NewFile(QuarantineDir, 0755|os.ModeDir, 0)
+
+				if err != nil {
+					return err
+				}
+
+				moved = true
+			}
+
+			err = s.RenameFile(f.Path, filepath.Join(QuarantineDir, fmt.Sprintf("%d_%s", f.ID, filepath.Base(f.Path))))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if moved {
+			files, err = s.filesByDepth()
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range files {
+		parentID := sql.NullInt64{}
+		dir := filepath.Dir(f.Path)
+
+		if !isRoot(dir) {
+			d, err := s.GetFile(dir)
+
+			if err != nil {
+				return err
+			}
+
+			if d == nil {
+				d, err = createParent(s, f.Path, 0755)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			if !d.Mode.IsDir() {
+				continue
+			}
+
+			parentID = sql.NullInt64{Int64: d.ID, Valid: true}
+		}
+
+		name := filepath.Base(f.Path)
+
+		if f.ParentID == parentID && f.Name == name {
+			continue
+		}
+
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET parentID=?, name=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName),
+			parentID, name, f.ID, s.namespace)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filesByDepth returns the files of the namespace, parents before children.
+// Deleted files are left out.
+func (s *storage) filesByDepth() ([]FileDB, error) {
+	files := []FileDB{}
+
+	err := s.sel(&files, fmt.Sprintf("SELECT %s FROM %s WHERE namespace=? AND deleted_at IS NULL ORDER BY %s", fileColumns, s.fileTableName, s.dialect.CharLength("path")), s.namespace)
+
+	return files, err
+}
+
+func isRoot(dir string) bool {
+	return dir == string(separator) || dir == "."
+}
@@ -0,0 +1,180 @@
+package mysqlfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressor - compression of file content. Every chunk is saved with a
+// header byte holding the ID of the compressor, so chunks compressed in
+// different ways and uncompressed chunks can be read from the same table.
+type Compressor interface {
+	// ID - header byte of the compressed chunks, 0 is reserved for
+	// uncompressed chunks and 0xff for encrypted ones
+	ID() byte
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+// noCompression - header byte of uncompressed chunks
+const noCompression byte = 0
+
+// Flate - compressor using compress/flate with the default level
+var Flate Compressor = flateCompressor{}
+
+// Gzip - compressor using compress/gzip with the default level
+var Gzip Compressor = gzipCompressor{}
+
+var compressors = struct {
+	sync.RWMutex
+	m map[byte]Compressor
+}{m: map[byte]Compressor{}}
+
+func init() {
+	RegisterCompressor(Flate)
+	RegisterCompressor(Gzip)
+}
+
+// RegisterCompressor makes the compressor available for reading chunks with
+// its ID. Flate and Gzip are registered by default.
+func RegisterCompressor(c Compressor) {
+	if c.ID() == noCompression || c.ID() == encryptedChunk {
+		panic(fmt.Sprintf("mysqlfs: compressor ID %d is reserved", c.ID()))
+	}
+
+	compressors.Lock()
+	defer compressors.Unlock()
+
+	compressors.m[c.ID()] = c
+}
+
+// encodeChunk adds the header byte to the data of the chunk of the file,
+// the data is compressed if it makes the chunk smaller and then encrypted if
+// there is a key provider
+func (s *storage) encodeChunk(fileID, chunkIndex int64, p []byte) ([]byte, error) {
+	res := append([]byte{noCompression}, p...)
+
+	if s.compressor != nil {
+		c, err := s.compressor.Compress(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(c) < len(p) {
+			res = append([]byte{s.compressor.ID()}, c...)
+		}
+	}
+
+	if s.keys != nil {
+		return s.encrypt(fileID, chunkIndex, res)
+	}
+
+	return res, nil
+}
+
+// decodeChunk returns the data of the chunk of the file saved by
+// encodeChunk
+func (s *storage) decodeChunk(fileID, chunkIndex int64, p []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return p, nil
+	}
+
+	if p[0] == encryptedChunk {
+		var err error
+		p, err = s.decrypt(fileID, chunkIndex, p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) == 0 {
+			return p, nil
+		}
+	}
+
+	if p[0] == noCompression {
+		return p[1:], nil
+	}
+
+	compressors.RLock()
+	c, ok := compressors.m[p[0]]
+	compressors.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor of chunk: %d", p[0])
+	}
+
+	return c.Decompress(p[1:])
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) ID() byte {
+	return 1
+}
+
+func (flateCompressor) Compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return compress(&b, w, p)
+}
+
+func (flateCompressor) Decompress(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte {
+	return 2
+}
+
+func (gzipCompressor) Compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	return compress(&b, gzip.NewWriter(&b), p)
+}
+
+func (gzipCompressor) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// compress writes p to w, which writes into b
+func compress(b *bytes.Buffer, w io.WriteCloser, p []byte) ([]byte, error) {
+	_, err := w.Write(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
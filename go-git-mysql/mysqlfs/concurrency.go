@@ -0,0 +1,37 @@
+package mysqlfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConcurrentModification - the content of the file was changed or the
+// file was removed by someone else after it was opened, so the buffered
+// writes of the file would overwrite that change
+var ErrConcurrentModification = errors.New("file was modified concurrently")
+
+// SwapFileVersion increments the content version of the row if it is still
+// the given one. It's run before the content written through a File is
+// saved, so the row stays locked until the transaction ends.
+func (s *storage) SwapFileVersion(fileID, version int64) error {
+	return s.withTx(func(s *storage) error {
+		r, err := s.exec(fmt.Sprintf("UPDATE %s SET content_version=content_version+1 WHERE id=? AND namespace=? AND content_version=?", s.fileTableName),
+			fileID, s.namespace, version)
+
+		if err != nil {
+			return err
+		}
+
+		n, err := r.RowsAffected()
+
+		if err != nil {
+			return err
+		}
+
+		if n != 1 {
+			return ErrConcurrentModification
+		}
+
+		return nil
+	})
+}
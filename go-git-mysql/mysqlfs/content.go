@@ -0,0 +1,468 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ChunkSize - file content is saved in db in chunks of this size, so reading
+// or writing a part of a file touches only the affected chunks
+const ChunkSize = 1024 * 1024
+
+// UpdateFileContent replaces the whole content of the file
+func (s *storage) UpdateFileContent(fileID int64, content []byte) error {
+	err := s.withTx(func(s *storage) error {
+		err := s.releaseBlobs("fileID=?", fileID)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE fileID=?", s.chunkTableName), fileID)
+
+		if err != nil {
+			return err
+		}
+
+		for i := int64(0); i*ChunkSize < int64(len(content)); i++ {
+			end := (i + 1) * ChunkSize
+			if end > int64(len(content)) {
+				end = int64(len(content))
+			}
+
+			data, err := s.encodeChunk(fileID, i, content[i*ChunkSize:end])
+
+			if err != nil {
+				return err
+			}
+
+			err = s.putChunk(fileID, i, data)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now().UnixNano()
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET size=?, mtime=?, ctime=?, version=version+1, content_version=content_version+1 WHERE id=? AND namespace=?", s.fileTableName), len(content), now, now, fileID, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		return s.recordWrite(fileID)
+	})
+
+	if err == nil {
+		s.stats().addBytes(int64(len(content)))
+	}
+
+	return err
+}
+
+// ReadFileContentAt reads len(p) bytes of the file starting at offset off.
+// Only the chunks covering the range are fetched, one at a time. Parts of
+// the file which were never written are read as zeros.
+func (s *storage) ReadFileContentAt(fileID int64, p []byte, off int64) (int, error) {
+	n := 0
+	eof := false
+
+	err := s.withTx(func(s *storage) error {
+		var err error
+		n, err = s.readFileContentAt(fileID, p, off)
+
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.stats().addBytes(int64(n))
+
+	if eof {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// readFileContentAt is ReadFileContentAt run in the transaction of s
+func (s *storage) readFileContentAt(fileID int64, p []byte, off int64) (int, error) {
+	size := int64(0)
+
+	err := s.get(&size, fmt.Sprintf("SELECT size FROM %s WHERE id=? AND namespace=?", s.fileTableName), fileID, s.namespace)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, os.ErrNotExist
+		}
+
+		return 0, err
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	n := int64(len(p))
+	if off+n > size {
+		n = size - off
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	for i := range p[:n] {
+		p[i] = 0
+	}
+
+	if s.compressor == nil && s.keys == nil {
+		err = s.readChunkParts(fileID, p[:n], off)
+	} else {
+		err = s.readChunks(fileID, p[:n], off)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+
+	return int(n), nil
+}
+
+// readChunks copies the decoded chunks which overlap with p into p, p holds
+// the file content starting at offset off
+func (s *storage) readChunks(fileID int64, p []byte, off int64) error {
+	rows, err := s.queryx(
+		fmt.Sprintf("SELECT chunkIndex, data, hash FROM %s WHERE fileID=? AND chunkIndex BETWEEN ? AND ? ORDER BY chunkIndex", s.chunkTableName),
+		fileID, off/ChunkSize, (off+int64(len(p))-1)/ChunkSize)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	// the blobs are read after the rows, a connection runs one query at a
+	// time
+	var refs []storedChunkDB
+
+	for rows.Next() {
+		c := storedChunkDB{}
+
+		err = rows.StructScan(&c)
+
+		if err != nil {
+			return err
+		}
+
+		if c.Data == nil && c.Hash.Valid {
+			refs = append(refs, c)
+			continue
+		}
+
+		err = s.copyChunk(fileID, p, off, &c)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return err
+	}
+
+	rows.Close()
+
+	for i := range refs {
+		refs[i].Data, err = s.blobData(&refs[i])
+
+		if err != nil {
+			return err
+		}
+
+		err = s.copyChunk(fileID, p, off, &refs[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyChunk decodes the saved data of the chunk of the file and copies the
+// part which overlaps with p, p holds the file content starting at offset off
+func (s *storage) copyChunk(fileID int64, p []byte, off int64, c *storedChunkDB) error {
+	data, err := s.decodeChunk(fileID, c.ChunkIndex, c.Data)
+
+	if err != nil {
+		return err
+	}
+
+	copyAt(p, off, c.ChunkIndex*ChunkSize, data)
+
+	return nil
+}
+
+// chunkPartDB - first byte of a chunk and a part of its data, or the hash
+// of the blob holding them
+type chunkPartDB struct {
+	ChunkIndex int64          `db:"chunkIndex"`
+	Head       []byte         `db:"head"`
+	Part       []byte         `db:"part"`
+	Hash       sql.NullString `db:"hash"`
+}
+
+// readChunkParts is readChunks which fetches only the parts of the chunks
+// overlapping with p, so small reads of a large file don't download whole
+// chunks. Chunks which aren't saved as plain data are fetched whole.
+func (s *storage) readChunkParts(fileID int64, p []byte, off int64) error {
+	first := off / ChunkSize
+	last := (off + int64(len(p)) - 1) / ChunkSize
+	// data starts with the header byte, positions are 1-based
+	from := off - first*ChunkSize + 2
+
+	parts := []chunkPartDB{}
+
+	err := s.sel(&parts, fmt.Sprintf("SELECT chunkIndex, %s AS head, %s AS part, hash FROM %s WHERE fileID=? AND chunkIndex BETWEEN ? AND ?",
+		s.dialect.Substring("data", "1", "1"), s.dialect.Substring("data", "CASE WHEN chunkIndex=? THEN ? ELSE 2 END", "?"), s.chunkTableName),
+		first, from, len(p), fileID, first, last)
+
+	if err != nil {
+		return err
+	}
+
+	for _, c := range parts {
+		if len(c.Head) == 0 && c.Hash.Valid {
+			pos := int64(2)
+			if c.ChunkIndex == first {
+				pos = from
+			}
+
+			err = s.get(&c, fmt.Sprintf("SELECT %s AS head, %s AS part FROM %s WHERE hash=?",
+				s.dialect.Substring("data", "1", "1"), s.dialect.Substring("data", "?", "?"), s.blobTableName),
+				pos, len(p), c.Hash.String)
+
+			if err == sql.ErrNoRows {
+				return ErrMissingBlob
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(c.Head) == 0 {
+			continue
+		}
+
+		if c.Head[0] != noCompression {
+			data, err := s.chunkData(fileID, c.ChunkIndex)
+
+			if err != nil {
+				return err
+			}
+
+			copyAt(p, off, c.ChunkIndex*ChunkSize, data)
+			continue
+		}
+
+		start := c.ChunkIndex * ChunkSize
+		if c.ChunkIndex == first {
+			start = off
+		}
+
+		copyAt(p, off, start, c.Part)
+	}
+
+	return nil
+}
+
+// chunkData returns the decoded data of the chunk
+func (s *storage) chunkData(fileID, chunkIndex int64) ([]byte, error) {
+	data, err := s.storedChunk(fileID, chunkIndex, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decodeChunk(fileID, chunkIndex, data)
+}
+
+// copyAt copies the part of data which overlaps with p, data holds the file
+// content starting at offset dataOff and p starting at offset off
+func copyAt(p []byte, off int64, dataOff int64, data []byte) {
+	from := off - dataOff
+	to := int64(0)
+
+	if from < 0 {
+		to = -from
+		from = 0
+	}
+
+	if from >= int64(len(data)) || to >= int64(len(p)) {
+		return
+	}
+
+	copy(p[to:], data[from:])
+}
+
+// WriteFileContentAt writes p to the file starting at offset off, the file
+// grows if needed. Chunks which are overwritten only partially are read and
+// merged with p.
+func (s *storage) WriteFileContentAt(fileID int64, p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	err := s.withTx(func(s *storage) error {
+		end := off + int64(len(p))
+
+		for i := off / ChunkSize; i*ChunkSize < end; i++ {
+			start := i * ChunkSize
+			from := off - start
+			if from < 0 {
+				from = 0
+			}
+
+			to := end - start
+			if to > ChunkSize {
+				to = ChunkSize
+			}
+
+			var data []byte
+
+			if from != 0 || to != ChunkSize {
+				var err error
+				data, err = s.readChunk(fileID, i)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			if int64(len(data)) < to {
+				data = append(data, make([]byte, to-int64(len(data)))...)
+			}
+
+			copy(data[from:to], p[start+from-off:])
+
+			err := s.writeChunk(fileID, i, data)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now().UnixNano()
+		_, err := s.exec(fmt.Sprintf("UPDATE %s SET size=%s, mtime=?, ctime=?, version=version+1, content_version=content_version+1 WHERE id=? AND namespace=?", s.fileTableName, s.dialect.Greatest("size", "?")), end, now, now, fileID, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		return s.recordWrite(fileID)
+	})
+
+	if err == nil {
+		s.stats().addBytes(int64(len(p)))
+	}
+
+	return err
+}
+
+// TruncateFileContent changes the size of the file. Chunks beyond the new
+// size are removed, a growing file reads zeros in the new part.
+func (s *storage) TruncateFileContent(fileID int64, size int64) error {
+	return s.withTx(func(s *storage) error {
+		// the index of the chunk which holds the new last byte
+		last := (size+ChunkSize-1)/ChunkSize - 1
+
+		err := s.releaseBlobs("fileID=? AND chunkIndex>?", fileID, last)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE fileID=? AND chunkIndex>?", s.chunkTableName), fileID, last)
+
+		if err != nil {
+			return err
+		}
+
+		if last >= 0 {
+			data, err := s.readChunk(fileID, last)
+
+			if err != nil {
+				return err
+			}
+
+			if int64(len(data)) > size-last*ChunkSize {
+				err = s.writeChunk(fileID, last, data[:size-last*ChunkSize])
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		now := time.Now().UnixNano()
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET size=?, mtime=?, ctime=?, version=version+1, content_version=content_version+1 WHERE id=? AND namespace=?", s.fileTableName), size, now, now, fileID, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		return s.recordWrite(fileID)
+	})
+}
+
+// readChunk returns the decoded data of the chunk locking it for update, nil
+// if there is no such chunk
+func (s *storage) readChunk(fileID, chunkIndex int64) ([]byte, error) {
+	data, err := s.storedChunk(fileID, chunkIndex, s.dialect.ForUpdate())
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return s.decodeChunk(fileID, chunkIndex, data)
+}
+
+// writeChunk encodes the data and saves it as the chunk, replacing the
+// existing one
+func (s *storage) writeChunk(fileID, chunkIndex int64, data []byte) error {
+	data, err := s.encodeChunk(fileID, chunkIndex, data)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.releaseBlobs("fileID=? AND chunkIndex=?", fileID, chunkIndex)
+
+	if err != nil {
+		return err
+	}
+
+	return s.putChunk(fileID, chunkIndex, data)
+}
@@ -0,0 +1,100 @@
+package mysqlfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// ErrCanceled - the context of the filesystem was canceled or its deadline
+// passed
+var ErrCanceled = errors.New("mysqlfs: context canceled")
+
+// ErrQueryTimeout - a query ran longer than Options.QueryTimeout
+var ErrQueryTimeout = errors.New("mysqlfs: query timeout")
+
+// NewWithContext creates an instance of billy.Filesystem running all its
+// queries with ctx. Operations fail with ErrCanceled after ctx is done.
+func NewWithContext(ctx context.Context, db *sql.DB, folderName string, options Options) (billy.Filesystem, error) {
+	fs, err := NewWithOptions(db, folderName, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	return mfs.WithContext(ctx), nil
+}
+
+// WithContext returns a view of the filesystem which runs its queries with
+// ctx. Files opened through the view keep using ctx.
+func (fs *Mysqlfs) WithContext(ctx context.Context) billy.Filesystem {
+	return newChroot(&Mysqlfs{storage: fs.storage.WithContext(ctx), options: fs.options, ctx: ctx})
+}
+
+// WithContext returns a copy of the storage running its queries with ctx
+func (s *storage) WithContext(ctx context.Context) Storage {
+	res := *s
+	res.ctx = ctx
+
+	return &res
+}
+
+// queryContext returns the context of a single query
+func (s *storage) queryContext() (context.Context, context.CancelFunc) {
+	if s.queryTimeout > 0 {
+		return context.WithTimeout(s.ctx, s.queryTimeout)
+	}
+
+	return s.ctx, func() {}
+}
+
+// ctxErr replaces err of the query run with ctx by ErrCanceled or
+// ErrQueryTimeout if the query was stopped by the context
+func (s *storage) ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if s.ctx.Err() != nil {
+		return ErrCanceled
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrQueryTimeout
+	}
+
+	return err
+}
+
+// queryRows - rows of a query, which release its context on Close
+type queryRows struct {
+	*sqlx.Rows
+	s      *storage
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r *queryRows) Next() bool {
+	if !r.Rows.Next() {
+		return false
+	}
+
+	r.s.stats().addRows(1)
+
+	return true
+}
+
+func (r *queryRows) Err() error {
+	return r.s.ctxErr(r.ctx, r.Rows.Err())
+}
+
+func (r *queryRows) Close() error {
+	defer r.cancel()
+
+	return r.Rows.Close()
+}
@@ -1,14 +1,17 @@
 package mysqlfs
 
 import (
+	"context"
 	"database/sql"
 	"os"
+	"time"
 )
 
 // Storage - an interface of storage working with files in db
 type Storage interface {
 	NewFile(path string, mode os.FileMode, flag int) (*File, error)
 	GetFile(path string) (*File, error)
+	GetFileByID(id int64) (*File, error)
 	GetFileID(path string) (int64, error)
 	RenameFile(from, to string) error
 	RemoveFile(path string) error
@@ -18,17 +21,58 @@ type Storage interface {
 	CreateParentAddToFile(path string, mode os.FileMode, f *File) error
 
 	UpdateFileContent(fileID int64, content []byte) error
+	UpdateFileMode(fileID int64, mode os.FileMode) error
+	UpdateFileOwner(fileID int64, uid, gid int) error
+	UpdateFileModTime(fileID int64, mtime time.Time) error
+	ReadFileContentAt(fileID int64, p []byte, off int64) (int, error)
+	WriteFileContentAt(fileID int64, p []byte, off int64) error
+	TruncateFileContent(fileID int64, size int64) error
+	// SwapFileVersion increments the content version of the file if it is
+	// still the given one and returns ErrConcurrentModification otherwise
+	SwapFileVersion(fileID, version int64) error
+
+	// TryLock, RefreshLock and Unlock manage advisory locks on paths, the
+	// lock of an owner which doesn't refresh it expires
+	TryLock(path, owner string, expiry time.Duration) (bool, error)
+	RefreshLock(path, owner string, expiry time.Duration) (bool, error)
+	Unlock(path, owner string) error
+
+	// Tx runs fn with a storage bound to one transaction, which is committed
+	// if fn succeeds and rolled back otherwise
+	Tx(fn func(s Storage) error) error
+	// WithContext returns a view of the storage which runs its queries with
+	// ctx and fails with ErrCanceled after ctx is done
+	WithContext(ctx context.Context) Storage
+	// Close releases the resources of the storage and of all its views
+	Close() error
 }
 
 //FileDB - main db obect for saving files
 type FileDB struct {
-	ID       int64         `db:"id"`
-	ParentID sql.NullInt64 `db:"parentID"`
-	Name     string        `db:"name"`
-	Path     string        `db:"path"`
-	Content  []byte        `db:"content"`
-	Flag     int           `db:"flag"`
-	Mode     int64         `db:"mode"`
+	ID        int64         `db:"id"`
+	Namespace string        `db:"namespace"`
+	ParentID  sql.NullInt64 `db:"parentID"`
+	Name      string        `db:"name"`
+	Path      string        `db:"path"`
+	Size      int64         `db:"size"`
+	Flag      int           `db:"flag"`
+	Mode      int64         `db:"mode"`
+	// MTime and CTime - modification and change times in unix nanoseconds
+	MTime int64 `db:"mtime"`
+	CTime int64 `db:"ctime"`
+	UID   int   `db:"uid"`
+	GID   int   `db:"gid"`
+	// Version - incremented by every change of the row
+	Version int64 `db:"version"`
+	// ContentVersion - incremented by every change of the content
+	ContentVersion int64 `db:"content_version"`
+}
+
+//ChunkDB - db object for saving a part of file content
+type ChunkDB struct {
+	FileID     int64  `db:"fileID"`
+	ChunkIndex int64  `db:"chunkIndex"`
+	Data       []byte `db:"data"`
 }
 
 //File - Mysql fs object, realizes interface billy.File
@@ -37,19 +81,53 @@ type File struct {
 	ParentID int64
 	FileName string
 	Path     string
-	Content  []byte
+	Size     int64
 	Position int64
 	Flag     int
 	Mode     os.FileMode
+	// ModTime - time of the last content change
+	ModTime time.Time
+	// ChangeTime - time of the last content or metadata change
+	ChangeTime time.Time
+	UID        int
+	GID        int
+	// Version - version of the row the file was read from
+	Version int64
+	// ContentVersion - version of the content the file was read from, the
+	// buffered writes are saved only if it wasn't changed since
+	ContentVersion int64
 
 	IsClosed bool
-	storage  *storage
+	storage  Storage
+
+	// buf - bytes written since the last flush, starting at offset bufOff
+	buf    []byte
+	bufOff int64
+	// truncated - the file was opened with O_TRUNC and db wasn't updated yet
+	truncated      bool
+	flushThreshold int
+
+	// lockOwner - id of the lock held by the file, lockDone stops renewing
+	// the lock
+	lockOwner  string
+	lockDone   chan struct{}
+	lockExpiry time.Duration
+
+	// observer - reports the operations of the file, which run with ctx.
+	// observing is set while an operation is being reported.
+	observer  Observer
+	ctx       context.Context
+	observing bool
 }
 
 // FileInfo - wrapper on os.FileMode with additional info
 type FileInfo struct {
-	FileID   int64
-	FileName string
-	FileSize int64
-	FileMode os.FileMode
+	FileID         int64
+	FileName       string
+	FileSize       int64
+	FileMode       os.FileMode
+	FileModTime    time.Time
+	FileChangeTime time.Time
+	UID            int
+	GID            int
 }
@@ -0,0 +1,324 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Dialect - SQL flavour of a db. mysqlfs builds all its queries with the
+// dialect, so the same filesystem works on MySQL, PostgreSQL and SQLite.
+// Other dbs can be supported by passing an own implementation in
+// Options.Dialect. The queries are written with "?" bind variables, which
+// sqlx rebinds by DriverName.
+type Dialect interface {
+	// DriverName - name which tells sqlx the format of bind variables
+	DriverName() string
+	// FoldsNames reports if the db returns unquoted column names in lower
+	// case
+	FoldsNames() bool
+	// IDColumn - definition of an auto increment primary key column id
+	IDColumn() string
+	// BlobType - column type for file content
+	BlobType() string
+	// Quote returns the identifier quoted for the db
+	Quote(name string) string
+	// CreateTable returns the statements creating the table with the
+	// columns and the indexes if it doesn't exist yet, each index is a
+	// list of columns. The name of the table is quoted by CreateTable.
+	CreateTable(table string, columns []string, indexes [][]string) []string
+	// ReturningID reports if the id of an inserted row is returned by
+	// "RETURNING id" instead of sql.Result.LastInsertId
+	ReturningID() bool
+	// InsertIgnore turns an INSERT statement into one which does nothing
+	// if the row already exists
+	InsertIgnore(insert string) string
+	// Upsert turns an INSERT statement into one which updates the columns
+	// of the row with the same key if it already exists
+	Upsert(insert string, key []string, columns []string) string
+	// UpsertAdd turns an INSERT statement into the table, whose name is
+	// quoted, into one which adds the inserted value of the column to the
+	// row with the same key if it already exists
+	UpsertAdd(insert string, table string, key []string, column string) string
+	// ForUpdate - suffix of SELECT which locks the selected rows
+	ForUpdate() string
+	// Columns - query of the names of the columns of the table, whose name
+	// is its only argument. It returns no rows if the table doesn't exist.
+	Columns() string
+	// Greatest, Concat and CharLength - the SQL functions of the db
+	Greatest(a, b string) string
+	Concat(a, b string) string
+	CharLength(s string) string
+	// Substring - length bytes of s starting at 1-based position from
+	Substring(s, from, length string) string
+	// Text casts s, usually a bind variable, to a string type, so the db
+	// doesn't need to infer its type
+	Text(s string) string
+}
+
+// MySQL - dialect of MySQL and MariaDB
+var MySQL Dialect = mysqlDialect{}
+
+// PostgreSQL - dialect of PostgreSQL
+var PostgreSQL Dialect = postgresDialect{ansiDialect{folds: true}}
+
+// SQLite - dialect of SQLite
+var SQLite Dialect = sqliteDialect{}
+
+// detectDialect chooses the dialect by the package of the db driver, MySQL
+// is used for unknown drivers
+func detectDialect(db *sql.DB) Dialect {
+	t := reflect.TypeOf(db.Driver())
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	pkg := t.PkgPath()
+
+	switch {
+	case strings.Contains(pkg, "sqlite"):
+		return SQLite
+	case strings.Contains(pkg, "lib/pq") || strings.Contains(pkg, "jackc/pgx"):
+		return PostgreSQL
+	default:
+		return MySQL
+	}
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) DriverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) FoldsNames() bool {
+	return false
+}
+
+func (mysqlDialect) IDColumn() string {
+	return "id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY"
+}
+
+func (mysqlDialect) BlobType() string {
+	return "LONGBLOB"
+}
+
+func (mysqlDialect) Quote(name string) string {
+	return "`" + name + "`"
+}
+
+// createTable keeps indexes in CREATE TABLE, MySQL has no CREATE INDEX IF
+// NOT EXISTS
+func (d mysqlDialect) CreateTable(table string, columns []string, indexes [][]string) []string {
+	defs := append([]string{}, columns...)
+	for _, idx := range indexes {
+		defs = append(defs, fmt.Sprintf("INDEX (%s)", strings.Join(idx, ", ")))
+	}
+
+	return []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", d.Quote(table), strings.Join(defs, ", "))}
+}
+
+func (mysqlDialect) ReturningID() bool {
+	return false
+}
+
+func (mysqlDialect) InsertIgnore(insert string) string {
+	return strings.Replace(insert, "INSERT", "INSERT IGNORE", 1)
+}
+
+func (mysqlDialect) Upsert(insert string, key []string, columns []string) string {
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = fmt.Sprintf("%s=VALUES(%s)", c, c)
+	}
+
+	return insert + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
+
+func (mysqlDialect) UpsertAdd(insert string, table string, key []string, column string) string {
+	return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s=%s+VALUES(%s)", insert, column, column, column)
+}
+
+func (mysqlDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (mysqlDialect) Columns() string {
+	return "SELECT column_name FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=?"
+}
+
+func (mysqlDialect) Greatest(a, b string) string {
+	return fmt.Sprintf("GREATEST(%s, %s)", a, b)
+}
+
+func (mysqlDialect) Concat(a, b string) string {
+	return fmt.Sprintf("CONCAT(%s, %s)", a, b)
+}
+
+func (mysqlDialect) CharLength(s string) string {
+	return fmt.Sprintf("CHAR_LENGTH(%s)", s)
+}
+
+func (mysqlDialect) Substring(s, from, length string) string {
+	return fmt.Sprintf("SUBSTRING(%s, %s, %s)", s, from, length)
+}
+
+func (mysqlDialect) Text(s string) string {
+	return s
+}
+
+// ansiDialect - the parts which are the same in PostgreSQL and SQLite
+type ansiDialect struct {
+	// folds - the db folds unquoted identifiers to lower case, quoted ones
+	// are folded too, so they name the same tables as before quoting
+	folds bool
+}
+
+func (d ansiDialect) Quote(name string) string {
+	if d.folds {
+		name = strings.ToLower(name)
+	}
+
+	return `"` + name + `"`
+}
+
+func (d ansiDialect) CreateTable(table string, columns []string, indexes [][]string) []string {
+	res := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", d.Quote(table), strings.Join(columns, ", "))}
+
+	for _, idx := range indexes {
+		res = append(res, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+			d.Quote(table+"_"+strings.Join(idx, "_")+"_idx"), d.Quote(table), strings.Join(idx, ", ")))
+	}
+
+	return res
+}
+
+func (ansiDialect) InsertIgnore(insert string) string {
+	return insert + " ON CONFLICT DO NOTHING"
+}
+
+func (ansiDialect) Upsert(insert string, key []string, columns []string) string {
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = fmt.Sprintf("%s=excluded.%s", c, c)
+	}
+
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insert, strings.Join(key, ", "), strings.Join(set, ", "))
+}
+
+// UpsertAdd qualifies the column of the existing row by the table, it's
+// ambiguous in PostgreSQL otherwise
+func (ansiDialect) UpsertAdd(insert string, table string, key []string, column string) string {
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s=%s.%s+excluded.%s", insert, strings.Join(key, ", "), column, table, column, column)
+}
+
+func (ansiDialect) Concat(a, b string) string {
+	return fmt.Sprintf("(%s || %s)", a, b)
+}
+
+type postgresDialect struct {
+	ansiDialect
+}
+
+func (postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) FoldsNames() bool {
+	return true
+}
+
+func (postgresDialect) IDColumn() string {
+	return "id BIGSERIAL PRIMARY KEY"
+}
+
+func (postgresDialect) BlobType() string {
+	return "BYTEA"
+}
+
+func (postgresDialect) ReturningID() bool {
+	return true
+}
+
+func (postgresDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) Columns() string {
+	return "SELECT column_name FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=?"
+}
+
+func (postgresDialect) Greatest(a, b string) string {
+	return fmt.Sprintf("GREATEST(%s, %s)", a, b)
+}
+
+func (postgresDialect) CharLength(s string) string {
+	return fmt.Sprintf("CHAR_LENGTH(%s)", s)
+}
+
+func (postgresDialect) Substring(s, from, length string) string {
+	return fmt.Sprintf("SUBSTRING(%s FROM %s FOR %s)", s, from, length)
+}
+
+// Text casts s, PostgreSQL can't choose between the functions taking text
+// and the ones taking other types by an untyped bind variable
+func (postgresDialect) Text(s string) string {
+	return fmt.Sprintf("CAST(%s AS TEXT)", s)
+}
+
+type sqliteDialect struct {
+	ansiDialect
+}
+
+func (sqliteDialect) DriverName() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) FoldsNames() bool {
+	return false
+}
+
+func (sqliteDialect) IDColumn() string {
+	return "id INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (sqliteDialect) BlobType() string {
+	return "BLOB"
+}
+
+func (sqliteDialect) ReturningID() bool {
+	return false
+}
+
+// ForUpdate is empty, SQLite locks the whole db for writing
+func (sqliteDialect) ForUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) Columns() string {
+	return "SELECT name FROM pragma_table_info(?)"
+}
+
+func (sqliteDialect) Greatest(a, b string) string {
+	return fmt.Sprintf("MAX(%s, %s)", a, b)
+}
+
+func (sqliteDialect) CharLength(s string) string {
+	return fmt.Sprintf("LENGTH(%s)", s)
+}
+
+func (sqliteDialect) Substring(s, from, length string) string {
+	return fmt.Sprintf("SUBSTR(%s, %s, %s)", s, from, length)
+}
+
+func (sqliteDialect) Text(s string) string {
+	return s
+}
+
+// DetectDialect returns the dialect of the db by its driver, as New does
+// when Options.Dialect is nil. Other packages keeping their tables next to
+// a filesystem, like mysqlstorage, build their statements with it.
+func DetectDialect(db *sql.DB) Dialect {
+	return detectDialect(db)
+}
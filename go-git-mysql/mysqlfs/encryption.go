@@ -0,0 +1,336 @@
+package mysqlfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// KeyProvider - wraps the data keys which encrypt file content with a key
+// encryption key of the caller, e.g. a key of a KMS. Only the wrapped data
+// keys are saved in db.
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the current key encryption key
+	// and returns the id of that key
+	WrapKey(key []byte) (wrapped []byte, kekID string, err error)
+	// UnwrapKey decrypts the data key wrapped with the key encryption key
+	// kekID
+	UnwrapKey(wrapped []byte, kekID string) ([]byte, error)
+}
+
+// ErrNoKeyProvider - encrypted content is read without Options.KeyProvider
+var ErrNoKeyProvider = errors.New("content is encrypted, but there is no key provider")
+
+// encryptedChunk - header byte of encrypted chunks. It is followed by the
+// version of the data key, the nonce and the sealed chunk encoded as it is
+// without encryption.
+const encryptedChunk byte = 0xff
+
+const dataKeySize = 32
+
+// dataKeyDB - db object for saving a wrapped data key of a namespace. Each
+// rotation adds a new version, content is encrypted with the latest one.
+type dataKeyDB struct {
+	Version int64  `db:"version"`
+	KekID   string `db:"kekID"`
+	DataKey []byte `db:"dataKey"`
+}
+
+// keyCache - unwrapped data keys by their wrapped values, so the provider
+// is called once for each key
+type keyCache struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+func (s *storage) unwrapKey(k *dataKeyDB) ([]byte, error) {
+	id := k.KekID + "\x00" + string(k.DataKey)
+
+	s.keyCache.Lock()
+	key, ok := s.keyCache.m[id]
+	s.keyCache.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	key, err := s.keys.UnwrapKey(k.DataKey, k.KekID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.keyCache.Lock()
+	s.keyCache.m[id] = key
+	s.keyCache.Unlock()
+
+	return key, nil
+}
+
+// dataKey returns the data key of the version, the latest one if version is
+// 0. The first data key of the namespace is created here.
+func (s *storage) dataKey(version int64) (*dataKeyDB, error) {
+	k := &dataKeyDB{}
+	var err error
+
+	if version == 0 {
+		err = s.get(k, fmt.Sprintf("SELECT version, kekID, dataKey FROM %s WHERE namespace=? ORDER BY version DESC LIMIT 1", s.keyTableName), s.namespace)
+	} else {
+		err = s.get(k, fmt.Sprintf("SELECT version, kekID, dataKey FROM %s WHERE namespace=? AND version=?", s.keyTableName), s.namespace, version)
+	}
+
+	if err == sql.ErrNoRows && version == 0 {
+		err = s.addDataKey(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return s.dataKey(0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// addDataKey creates a new data key with the version, nothing is done if
+// it already exists
+func (s *storage) addDataKey(version int64) error {
+	key := make([]byte, dataKeySize)
+
+	_, err := rand.Read(key)
+
+	if err != nil {
+		return err
+	}
+
+	wrapped, kekID, err := s.keys.WrapKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(namespace, version, kekID, dataKey) VALUES(?,?,?,?)", s.keyTableName)),
+		s.namespace, version, kekID, wrapped)
+
+	return err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkAAD returns the data authenticated with the sealed chunk: its header
+// and the namespace, file and index of the chunk, so a sealed chunk can't
+// be moved to another place
+func (s *storage) chunkAAD(header []byte, fileID, chunkIndex int64) []byte {
+	aad := make([]byte, len(header)+16, len(header)+16+len(s.namespace))
+	copy(aad, header)
+	binary.BigEndian.PutUint64(aad[len(header):], uint64(fileID))
+	binary.BigEndian.PutUint64(aad[len(header)+8:], uint64(chunkIndex))
+
+	return append(aad, s.namespace...)
+}
+
+// encrypt seals the chunk with the latest data key of the namespace
+func (s *storage) encrypt(fileID, chunkIndex int64, p []byte) ([]byte, error) {
+	k, err := s.dataKey(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.unwrapKey(k)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 5+gcm.NonceSize(), 5+gcm.NonceSize()+len(p)+gcm.Overhead())
+	res[0] = encryptedChunk
+	binary.BigEndian.PutUint32(res[1:5], uint32(k.Version))
+	nonce := res[5:]
+
+	_, err = rand.Read(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(res, nonce, p, s.chunkAAD(res[:5], fileID, chunkIndex)), nil
+}
+
+// decrypt opens the chunk sealed by encrypt
+func (s *storage) decrypt(fileID, chunkIndex int64, p []byte) ([]byte, error) {
+	if s.keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+
+	if len(p) < 5 {
+		return nil, errors.New("encrypted chunk is too short")
+	}
+
+	k, err := s.dataKey(int64(binary.BigEndian.Uint32(p[1:5])))
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.unwrapKey(k)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p) < 5+gcm.NonceSize() {
+		return nil, errors.New("encrypted chunk is too short")
+	}
+
+	return gcm.Open(nil, p[5:5+gcm.NonceSize()], p[5+gcm.NonceSize():], s.chunkAAD(p[:5], fileID, chunkIndex))
+}
+
+// reseal opens the chunk of the file from and seals it as the chunk of the
+// file to in the namespace, which has the same data keys
+func (s *storage) reseal(from, to, chunkIndex int64, namespace string, p []byte) ([]byte, error) {
+	p, err := s.decrypt(from, chunkIndex, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ts := *s
+	ts.namespace = namespace
+
+	return ts.encrypt(to, chunkIndex, p)
+}
+
+// RotateKeys wraps all the data keys of the namespace with the current key
+// encryption key of the KeyProvider and adds a new data key, which
+// encrypts the content written from now on. Use Reencrypt to encrypt the
+// existing content with the new data key.
+func (fs *Mysqlfs) RotateKeys() error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok || s.keys == nil {
+		return ErrNoKeyProvider
+	}
+
+	return s.withTx(func(s *storage) error {
+		keys := []dataKeyDB{}
+
+		err := s.sel(&keys, fmt.Sprintf("SELECT version, kekID, dataKey FROM %s WHERE namespace=?%s", s.keyTableName, s.dialect.ForUpdate()), s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		last := int64(0)
+
+		for _, k := range keys {
+			key, err := s.unwrapKey(&k)
+
+			if err != nil {
+				return err
+			}
+
+			wrapped, kekID, err := s.keys.WrapKey(key)
+
+			if err != nil {
+				return err
+			}
+
+			_, err = s.exec(fmt.Sprintf("UPDATE %s SET kekID=?, dataKey=? WHERE namespace=? AND version=?", s.keyTableName),
+				kekID, wrapped, s.namespace, k.Version)
+
+			if err != nil {
+				return err
+			}
+
+			if k.Version > last {
+				last = k.Version
+			}
+		}
+
+		return s.addDataKey(last + 1)
+	})
+}
+
+// Reencrypt encrypts all the content of the namespace with the latest data
+// key, including the files in the trash. Each file is reencrypted in its own
+// transaction. The content saved by snapshots isn't reencrypted, so the
+// previous data keys are still used by the snapshots taken before.
+func (fs *Mysqlfs) Reencrypt() error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok || s.keys == nil {
+		return ErrNoKeyProvider
+	}
+
+	ids := []int64{}
+
+	err := s.sel(&ids, fmt.Sprintf("SELECT id FROM %s WHERE namespace=?", s.fileTableName), s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = s.withTx(func(s *storage) error {
+			indexes := []int64{}
+
+			err := s.sel(&indexes, fmt.Sprintf("SELECT chunkIndex FROM %s WHERE fileID=?", s.chunkTableName), id)
+
+			if err != nil {
+				return err
+			}
+
+			for _, i := range indexes {
+				data, err := s.readChunk(id, i)
+
+				if err != nil {
+					return err
+				}
+
+				err = s.writeChunk(id, i, data)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,376 @@
+package mysqlfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/helper/chroot"
+)
+
+// Export writes all the files of fs into w as a tar stream. Modes, symlinks
+// and modification times, also of symlinks, are kept. If fs is a mysqlfs
+// filesystem, the files are read in one transaction.
+func Export(fs billy.Filesystem, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := withFsTx(fs, func(fs billy.Filesystem) error {
+		return walk(fs, func(hdr *tar.Header, r io.Reader) error {
+			err := tw.WriteHeader(hdr)
+
+			if err != nil || r == nil {
+				return err
+			}
+
+			_, err = io.Copy(tw, r)
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Import creates the files of the tar stream r in fs, existing files are
+// replaced. If fs is a mysqlfs filesystem, all the files are created in one
+// transaction.
+func Import(fs billy.Filesystem, r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	return withFsTx(fs, func(fs billy.Filesystem) error {
+		var dirs []*tar.Header
+
+		for {
+			hdr, err := tr.Next()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+
+			// the root of fs, e.g. the entry "./", isn't a file
+			if isRoot(path.Clean("/" + hdr.Name)) {
+				continue
+			}
+
+			if hdr.Typeflag == tar.TypeDir {
+				dirs = append(dirs, hdr)
+			}
+
+			err = writeEntry(fs, hdr, tr)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return setDirTimes(fs, dirs)
+	})
+}
+
+// Copy copies all the files of src into dst, existing files are replaced.
+// Modes, symlinks and modification times are kept. If src or dst is a
+// mysqlfs filesystem, it's read or written in one transaction.
+func Copy(src, dst billy.Filesystem) error {
+	return withFsTx(src, func(src billy.Filesystem) error {
+		return withFsTx(dst, func(dst billy.Filesystem) error {
+			var dirs []*tar.Header
+
+			err := walk(src, func(hdr *tar.Header, r io.Reader) error {
+				if hdr.Typeflag == tar.TypeDir {
+					dirs = append(dirs, hdr)
+				}
+
+				return writeEntry(dst, hdr, r)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return setDirTimes(dst, dirs)
+		})
+	})
+}
+
+// withFsTx runs fn in a transaction if fs is a mysqlfs filesystem
+func withFsTx(fs billy.Filesystem, fn func(fs billy.Filesystem) error) error {
+	if mfs, ok := unwrapRoot(fs); ok {
+		return mfs.Tx(fn)
+	}
+
+	return fn(fs)
+}
+
+// unwrapRoot returns the Mysqlfs behind fs if the paths of fs are the same
+// as the paths of the Mysqlfs
+func unwrapRoot(fs billy.Basic) (*Mysqlfs, bool) {
+	for {
+		switch v := fs.(type) {
+		case *Mysqlfs:
+			return v, true
+		case *chroot.ChrootHelper:
+			if v.Root() != string(separator) {
+				return nil, false
+			}
+
+			fs = v.Underlying()
+		case interface{ Underlying() billy.Basic }:
+			fs = v.Underlying()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// asChange returns fs as billy.Change, nil if it can't change the named
+// file. osfs doesn't implement billy.Change, so the files which fs keeps
+// on disk under its root are changed by os.
+func asChange(fs billy.Filesystem, name string) billy.Change {
+	if c, ok := fs.(billy.Change); ok {
+		return c
+	}
+
+	if mfs, ok := unwrapRoot(fs); ok {
+		return mfs
+	}
+
+	fi, err := fs.Lstat(name)
+
+	if err != nil {
+		return nil
+	}
+
+	osfi, err := os.Lstat(filepath.Join(fs.Root(), name))
+
+	if err != nil || !os.SameFile(fi, osfi) {
+		return nil
+	}
+
+	return osChange{root: fs.Root()}
+}
+
+// lchtimer - filesystem which changes the times of symlinks, like Mysqlfs
+type lchtimer interface {
+	Lchtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// osChange - billy.Change of the files of osfs under root
+type osChange struct {
+	root string
+}
+
+func (c osChange) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(c.root, name), mode)
+}
+
+func (c osChange) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c osChange) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(c.root, name), uid, gid)
+}
+
+func (c osChange) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(c.root, name), atime, mtime)
+}
+
+// walk calls fn for every file of fs with the tar header describing it,
+// parents before children. r reads the content of regular files and is
+// nil for others.
+func walk(fs billy.Filesystem, fn func(hdr *tar.Header, r io.Reader) error) error {
+	return walkDir(fs, string(separator), fn)
+}
+
+func walkDir(fs billy.Filesystem, dir string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	infos, err := fs.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	for _, info := range infos {
+		name := fs.Join(dir, info.Name())
+
+		fi, err := fs.Lstat(name)
+
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(filepath.ToSlash(name), "/"),
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: fi.ModTime(),
+		}
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname, err = fs.Readlink(name)
+
+			if err != nil {
+				return err
+			}
+
+			err = fn(hdr, nil)
+		case fi.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+
+			err = fn(hdr, nil)
+
+			if err == nil {
+				err = walkDir(fs, name, fn)
+			}
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+
+			err = walkFile(fs, name, hdr, fn)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkFile(fs billy.Filesystem, name string, hdr *tar.Header, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := fs.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return fn(hdr, io.LimitReader(f, hdr.Size))
+}
+
+// writeEntry creates the file described by the tar header in fs, other
+// types than dirs, symlinks and regular files are skipped
+func writeEntry(fs billy.Filesystem, hdr *tar.Header, r io.Reader) error {
+	// the name is kept inside of the root of fs
+	name := filepath.FromSlash(path.Clean("/" + hdr.Name))
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return fs.MkdirAll(name, mode)
+	case tar.TypeSymlink:
+		err := fs.MkdirAll(filepath.Dir(name), 0755)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fs.Lstat(name)
+
+		if err == nil {
+			err = fs.Remove(name)
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = fs.Symlink(hdr.Linkname, name)
+
+		if err != nil {
+			return err
+		}
+
+		return setLinkTime(fs, name, hdr.ModTime)
+	case tar.TypeReg, tar.TypeRegA:
+		err := fs.MkdirAll(filepath.Dir(name), 0755)
+
+		if err != nil {
+			return err
+		}
+
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, r)
+
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return setAttrs(fs, name, mode, hdr.ModTime)
+	}
+
+	return nil
+}
+
+// setDirTimes sets the modes and the modification times of the dirs after
+// their content is written, which changes the times
+func setDirTimes(fs billy.Filesystem, dirs []*tar.Header) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := setAttrs(fs, filepath.FromSlash(path.Clean("/"+dirs[i].Name)), os.FileMode(dirs[i].Mode).Perm(), dirs[i].ModTime)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setLinkTime sets the modification time of the symlink itself if fs can
+// change it, os can't
+func setLinkTime(fs billy.Filesystem, name string, mtime time.Time) error {
+	var l lchtimer
+
+	if mfs, ok := unwrapRoot(fs); ok {
+		l = mfs
+	} else if l, ok = fs.(lchtimer); !ok {
+		return nil
+	}
+
+	return l.Lchtimes(name, mtime, mtime)
+}
+
+// setAttrs sets the mode and the modification time of the file if fs can
+// change them
+func setAttrs(fs billy.Filesystem, name string, mode os.FileMode, mtime time.Time) error {
+	c := asChange(fs, name)
+
+	if c == nil {
+		return nil
+	}
+
+	err := c.Chmod(name, mode)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Chtimes(name, mtime, mtime)
+}
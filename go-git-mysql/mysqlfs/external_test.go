@@ -0,0 +1,135 @@
+package mysqlfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ujent/go-git-mysql/mysqlfs"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+// foreignStorage - a Storage declared outside of mysqlfs, its files aren't
+// bound to a storage
+type foreignStorage struct {
+	mysqlfs.Storage
+}
+
+func foreignFile(f *mysqlfs.File) *mysqlfs.File {
+	if f == nil {
+		return nil
+	}
+
+	return &mysqlfs.File{
+		ID:             f.ID,
+		ParentID:       f.ParentID,
+		FileName:       f.FileName,
+		Path:           f.Path,
+		Size:           f.Size,
+		Flag:           f.Flag,
+		Mode:           f.Mode,
+		ModTime:        f.ModTime,
+		ChangeTime:     f.ChangeTime,
+		UID:            f.UID,
+		GID:            f.GID,
+		Version:        f.Version,
+		ContentVersion: f.ContentVersion,
+	}
+}
+
+func (s foreignStorage) GetFile(path string) (*mysqlfs.File, error) {
+	f, err := s.Storage.GetFile(path)
+	return foreignFile(f), err
+}
+
+func (s foreignStorage) GetFileByID(id int64) (*mysqlfs.File, error) {
+	f, err := s.Storage.GetFileByID(id)
+	return foreignFile(f), err
+}
+
+func (s foreignStorage) NewFile(path string, mode os.FileMode, flag int) (*mysqlfs.File, error) {
+	f, err := s.Storage.NewFile(path, mode, flag)
+	return foreignFile(f), err
+}
+
+func (s foreignStorage) Tx(fn func(s mysqlfs.Storage) error) error {
+	return s.Storage.Tx(func(s mysqlfs.Storage) error {
+		return fn(foreignStorage{s})
+	})
+}
+
+func (s foreignStorage) WithContext(ctx context.Context) mysqlfs.Storage {
+	return foreignStorage{s.Storage.WithContext(ctx)}
+}
+
+func readFile(fs billy.Filesystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func TestForeignStorage(t *testing.T) {
+	fs := mysqlfs.NewWithStorage(foreignStorage{mysqlfs.NewMemoryStorage()}, mysqlfs.Options{})
+
+	err := util.WriteFile(fs, "/dir/file1.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := readFile(fs, "/dir/file1.txt")
+	if string(content) != "Hello" || err != nil {
+		t.Errorf("Wrong content: %q, %v", content, err)
+	}
+
+	err = fs.Symlink("/dir", "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Symlink("/dir/file1.txt", "/link1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat("/link1")
+	if err != nil || fi.Size() != 5 {
+		t.Errorf("Wrong stat through link: %v, %v", fi, err)
+	}
+
+	fi, err = fs.Stat("/link")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("Wrong stat of link: %v, %v", fi, err)
+	}
+
+	entries, err := fs.ReadDir("/link")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "file1.txt" {
+		t.Errorf("Wrong entries through link: %v, %v", entries, err)
+	}
+
+	f, err := fs.OpenFile("/link1", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write([]byte("J"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err = readFile(fs, "/dir/file1.txt")
+	if string(content) != "Jello" || err != nil {
+		t.Errorf("Wrong content: %q, %v", content, err)
+	}
+}
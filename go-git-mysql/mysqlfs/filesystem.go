@@ -2,6 +2,7 @@
 package mysqlfs
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -19,23 +20,118 @@ import (
 //Mysqlfs - realization of billy.Flesystem based on MySQL
 type Mysqlfs struct {
 	storage Storage
+	options Options
+	// ctx - context of the queries of the filesystem
+	ctx context.Context
+	// observed - the filesystem runs the queries of an observed operation,
+	// the operations it's used for are part of that one
+	observed bool
 }
 
+var _ billy.Change = (*Mysqlfs)(nil)
+
 //New creates an instance of billy.Filesystem
 func New(db *sql.DB, folderName string) (billy.Filesystem, error) {
+	return NewWithOptions(db, folderName, Options{})
+}
+
+//NewWithOptions creates an instance of billy.Filesystem with the given options
+func NewWithOptions(db *sql.DB, folderName string, options Options) (billy.Filesystem, error) {
 	if folderName == "" {
 		return nil, errors.New("Folder name can't be empty")
 	}
 
-	storage, err := newStorage(db, folderName)
+	storage, err := newStorage(db, folderName, options)
 
 	if err != nil {
 		return nil, err
 	}
 
-	fs := &Mysqlfs{storage: storage}
+	if options.Namespace != "" {
+		err = storage.registerNamespace(options.Namespace)
+
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	return NewWithStorage(storage, options), nil
+}
+
+// NewWithStorage creates an instance of billy.Filesystem keeping files in
+// the given storage, e.g. the one returned by NewMemoryStorage. Options
+// which configure db are ignored.
+func NewWithStorage(s Storage, options Options) billy.Filesystem {
+	fs := &Mysqlfs{storage: s, options: options, ctx: context.Background()}
 
-	return chroot.New(fs, string(separator)), nil
+	return newChroot(fs)
+}
+
+// changeChroot - the chroot a Mysqlfs is wrapped into, it implements
+// billy.Change, which chroot.ChrootHelper doesn't
+type changeChroot struct {
+	billy.Filesystem
+	fs *Mysqlfs
+}
+
+func newChroot(fs *Mysqlfs) billy.Filesystem {
+	return &changeChroot{Filesystem: chroot.New(fs, string(separator)), fs: fs}
+}
+
+// Underlying returns the wrapped Mysqlfs, the root of the chroot is the
+// root of the Mysqlfs
+func (c *changeChroot) Underlying() billy.Basic {
+	return c.fs
+}
+
+func (c *changeChroot) Chmod(name string, mode os.FileMode) error {
+	return c.fs.Chmod(c.Join(c.Root(), name), mode)
+}
+
+func (c *changeChroot) Lchown(name string, uid, gid int) error {
+	return c.fs.Lchown(c.Join(c.Root(), name), uid, gid)
+}
+
+func (c *changeChroot) Chown(name string, uid, gid int) error {
+	return c.fs.Chown(c.Join(c.Root(), name), uid, gid)
+}
+
+func (c *changeChroot) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.fs.Chtimes(c.Join(c.Root(), name), atime, mtime)
+}
+
+func (c *changeChroot) Lchtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.fs.Lchtimes(c.Join(c.Root(), name), atime, mtime)
+}
+
+// Tx runs fn in one db transaction. All the changes fn makes through the
+// given filesystem are committed together if fn returns nil and rolled back
+// otherwise. Files opened in fn must be closed before it returns, the
+// buffered writes of a file left open are lost. Calling Tx on the filesystem
+// passed to fn joins the running transaction.
+func (fs *Mysqlfs) Tx(fn func(fs billy.Filesystem) error) (err error) {
+	ofs, done := fs.observe("Tx", "")
+	defer func() { done(err) }()
+
+	return ofs.storage.Tx(func(s Storage) error {
+		return fn(newChroot(&Mysqlfs{storage: s, options: fs.options, ctx: fs.ctx}))
+	})
+}
+
+// Unwrap returns the Mysqlfs behind fs, which may be wrapped into a chroot
+// as New does
+func Unwrap(fs billy.Basic) (*Mysqlfs, bool) {
+	for {
+		switch v := fs.(type) {
+		case *Mysqlfs:
+			return v, true
+		case interface{ Underlying() billy.Basic }:
+			fs = v.Underlying()
+		default:
+			return nil, false
+		}
+	}
 }
 
 // Create creates the named file with mode 0666 (before umask), truncating
@@ -57,7 +153,26 @@ func (fs *Mysqlfs) Open(filename string) (billy.File, error) {
 // perm, (0666 etc.) if applicable. If successful, methods on the returned
 // File can be used for I/O.
 func (fs *Mysqlfs) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
-	f, err := fs.storage.GetFile(filename)
+	ofs, done := fs.observe("OpenFile", filename)
+	f, err := ofs.openFile(filename, flag, perm)
+	done(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// files opened by another operation are part of it
+	if !fs.observed {
+		f.observer = fs.options.Observer
+	}
+
+	f.ctx = fs.ctx
+
+	return f, nil
+}
+
+func (fs *Mysqlfs) openFile(filename string, flag int, perm os.FileMode) (*File, error) {
+	f, err := fs.getFile(filename)
 
 	if err != nil {
 		return nil, err
@@ -75,9 +190,17 @@ func (fs *Mysqlfs) OpenFile(filename string, flag int, perm os.FileMode) (billy.
 			return nil, err
 		}
 
+		fs.bind(f)
+
 	} else {
-		if target, isLink := fs.resolveLink(filename, f); isLink {
-			return fs.OpenFile(target, flag, perm)
+		target, isLink, err := fs.resolveLink(filename, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if isLink {
+			return fs.openFile(target, flag, perm)
 		}
 	}
 
@@ -85,20 +208,34 @@ func (fs *Mysqlfs) OpenFile(filename string, flag int, perm os.FileMode) (billy.
 		return nil, fmt.Errorf("cannot open directory: %s", filename)
 	}
 
-	return f.Duplicate(perm, flag), nil
+	f.flushThreshold = fs.options.flushThreshold()
+	f.lockExpiry = fs.options.lockExpiry()
+	new, err := f.duplicate(perm, flag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new, nil
 }
 
-func (fs *Mysqlfs) resolveLink(fullpath string, f *File) (target string, isLink bool) {
+func (fs *Mysqlfs) resolveLink(fullpath string, f *File) (target string, isLink bool, err error) {
 	if !isSymlink(f.Mode) {
-		return fullpath, false
+		return fullpath, false, nil
 	}
 
-	target = string(f.Content)
+	content, err := f.content()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	target = string(content)
 	if !isAbs(target) {
 		target = fs.Join(filepath.Dir(fullpath), target)
 	}
 
-	return target, true
+	return target, true, nil
 }
 
 // On Windows OS, IsAbs validates if a path is valid based on if stars with a
@@ -109,8 +246,11 @@ func isAbs(path string) bool {
 }
 
 // Stat returns a FileInfo describing the named file.
-func (fs *Mysqlfs) Stat(filename string) (os.FileInfo, error) {
-	f, err := fs.storage.GetFile(filename)
+func (fs *Mysqlfs) Stat(filename string) (fi os.FileInfo, err error) {
+	fs, done := fs.observe("Stat", filename)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(filename)
 
 	if err != nil {
 		return nil, err
@@ -120,13 +260,19 @@ func (fs *Mysqlfs) Stat(filename string) (os.FileInfo, error) {
 		return nil, os.ErrNotExist
 	}
 
-	fi, err := f.Stat()
+	fi, err = f.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	target, isLink, err := fs.resolveLink(filename, f)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if target, isLink := fs.resolveLink(filename, f); isLink {
+	if isLink {
 		fi, err = fs.Stat(target)
 		if err != nil {
 			return nil, err
@@ -144,12 +290,18 @@ func (fs *Mysqlfs) Stat(filename string) (os.FileInfo, error) {
 // Rename renames (moves) oldpath to newpath. If newpath already exists and
 // is not a directory, Rename replaces it. OS-specific restrictions may
 // apply when oldpath and newpath are in different directories.
-func (fs *Mysqlfs) Rename(oldpath, newpath string) error {
+func (fs *Mysqlfs) Rename(oldpath, newpath string) (err error) {
+	fs, done := fs.observe("Rename", oldpath)
+	defer func() { done(err) }()
+
 	return fs.storage.RenameFile(oldpath, newpath)
 }
 
 // Remove removes the named file or directory.
-func (fs *Mysqlfs) Remove(filename string) error {
+func (fs *Mysqlfs) Remove(filename string) (err error) {
+	fs, done := fs.observe("Remove", filename)
+	defer func() { done(err) }()
+
 	return fs.storage.RemoveFile(filename)
 }
 
@@ -175,20 +327,28 @@ func (fs *Mysqlfs) TempFile(dir, prefix string) (billy.File, error) {
 
 // ReadDir reads the directory named by dirname and returns a list of
 // directory entries sorted by filename.
-func (fs *Mysqlfs) ReadDir(path string) ([]os.FileInfo, error) {
-	f, err := fs.storage.GetFile(path)
+func (fs *Mysqlfs) ReadDir(path string) (entries []os.FileInfo, err error) {
+	fs, done := fs.observe("ReadDir", path)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(path)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if f != nil {
-		if target, isLink := fs.resolveLink(path, f); isLink {
+		target, isLink, err := fs.resolveLink(path, f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if isLink {
 			return fs.ReadDir(target)
 		}
 	}
 
-	var entries []os.FileInfo
 	children, err := fs.storage.Children(path)
 
 	if err != nil {
@@ -207,8 +367,16 @@ func (fs *Mysqlfs) ReadDir(path string) ([]os.FileInfo, error) {
 // parents, and returns nil, or else returns an error. The permission bits
 // perm are used for all directories that MkdirAll creates. If path is/
 // already a directory, MkdirAll does nothing and returns nil.
-func (fs *Mysqlfs) MkdirAll(path string, perm os.FileMode) error {
-	_, err := fs.storage.NewFile(path, perm|os.ModeDir, 0)
+func (fs *Mysqlfs) MkdirAll(path string, perm os.FileMode) (err error) {
+	fs, done := fs.observe("MkdirAll", path)
+	defer func() { done(err) }()
+
+	// the root always exists, it has no row
+	if isRoot(clean(path)) {
+		return nil
+	}
+
+	_, err = fs.storage.NewFile(path, perm|os.ModeDir, 0)
 
 	return err
 }
@@ -216,8 +384,11 @@ func (fs *Mysqlfs) MkdirAll(path string, perm os.FileMode) error {
 // Lstat returns a FileInfo describing the named file. If the file is a
 // symbolic link, the returned FileInfo describes the symbolic link. Lstat
 // makes no attempt to follow the link.
-func (fs *Mysqlfs) Lstat(filename string) (os.FileInfo, error) {
-	f, err := fs.storage.GetFile(filename)
+func (fs *Mysqlfs) Lstat(filename string) (fi os.FileInfo, err error) {
+	fs, done := fs.observe("Lstat", filename)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(filename)
 
 	if err != nil {
 		return nil, err
@@ -233,8 +404,11 @@ func (fs *Mysqlfs) Lstat(filename string) (os.FileInfo, error) {
 // Symlink creates a symbolic-link from link to target. target may be an
 // absolute or relative path, and need not refer to an existing node.
 // Parent directories of link are created as necessary.
-func (fs *Mysqlfs) Symlink(target, link string) error {
-	_, err := fs.Stat(link)
+func (fs *Mysqlfs) Symlink(target, link string) (err error) {
+	fs, done := fs.observe("Symlink", link)
+	defer func() { done(err) }()
+
+	_, err = fs.Stat(link)
 	if err == nil {
 		return os.ErrExist
 	}
@@ -247,8 +421,11 @@ func (fs *Mysqlfs) Symlink(target, link string) error {
 }
 
 // Readlink returns the target path of link.
-func (fs *Mysqlfs) Readlink(link string) (string, error) {
-	f, err := fs.storage.GetFile(link)
+func (fs *Mysqlfs) Readlink(link string) (target string, err error) {
+	fs, done := fs.observe("Readlink", link)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(link)
 
 	if err != nil {
 		return "", err
@@ -266,7 +443,142 @@ func (fs *Mysqlfs) Readlink(link string) (string, error) {
 		}
 	}
 
-	return string(f.Content), nil
+	content, err := f.content()
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// Chmod changes the mode of the named file to mode. If the file is a
+// symbolic link, it changes the mode of the link's target.
+func (fs *Mysqlfs) Chmod(name string, mode os.FileMode) (err error) {
+	fs, done := fs.observe("Chmod", name)
+	defer func() { done(err) }()
+
+	f, err := fs.followLink(name)
+
+	if err != nil {
+		return err
+	}
+
+	return fs.storage.UpdateFileMode(f.ID, f.Mode&^chmodMask|mode&chmodMask)
+}
+
+// Lchown changes the numeric uid and gid of the named file. If the file is
+// a symbolic link, it changes the uid and gid of the link itself.
+func (fs *Mysqlfs) Lchown(name string, uid, gid int) (err error) {
+	fs, done := fs.observe("Lchown", name)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(name)
+
+	if err != nil {
+		return err
+	}
+
+	if f == nil {
+		return os.ErrNotExist
+	}
+
+	return fs.storage.UpdateFileOwner(f.ID, uid, gid)
+}
+
+// Chown changes the numeric uid and gid of the named file. If the file is a
+// symbolic link, it changes the uid and gid of the link's target.
+func (fs *Mysqlfs) Chown(name string, uid, gid int) (err error) {
+	fs, done := fs.observe("Chown", name)
+	defer func() { done(err) }()
+
+	f, err := fs.followLink(name)
+
+	if err != nil {
+		return err
+	}
+
+	return fs.storage.UpdateFileOwner(f.ID, uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file.
+// Access times aren't saved in db, so atime is ignored.
+func (fs *Mysqlfs) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	fs, done := fs.observe("Chtimes", name)
+	defer func() { done(err) }()
+
+	f, err := fs.followLink(name)
+
+	if err != nil {
+		return err
+	}
+
+	return fs.storage.UpdateFileModTime(f.ID, mtime)
+}
+
+// Lchtimes changes the modification time of the named file. If the file is
+// a symbolic link, it changes the time of the link itself.
+func (fs *Mysqlfs) Lchtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	fs, done := fs.observe("Lchtimes", name)
+	defer func() { done(err) }()
+
+	f, err := fs.getFile(name)
+
+	if err != nil {
+		return err
+	}
+
+	if f == nil {
+		return os.ErrNotExist
+	}
+
+	return fs.storage.UpdateFileModTime(f.ID, mtime)
+}
+
+// getFile returns the named file bound to the storage of fs
+func (fs *Mysqlfs) getFile(name string) (*File, error) {
+	f, err := fs.storage.GetFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.bind(f), nil
+}
+
+// bind binds the file returned by the storage to it. A Storage declared in
+// another package can't set the storage of its files.
+func (fs *Mysqlfs) bind(f *File) *File {
+	if f != nil && f.storage == nil {
+		f.storage = fs.storage
+	}
+
+	return f
+}
+
+// followLink returns the named file or the target of the link
+func (fs *Mysqlfs) followLink(name string) (*File, error) {
+	f, err := fs.getFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+
+	target, isLink, err := fs.resolveLink(name, f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isLink {
+		return fs.followLink(target)
+	}
+
+	return f, nil
 }
 
 // Capabilities implements the Capable interface.
@@ -275,7 +587,8 @@ func (fs *Mysqlfs) Capabilities() billy.Capability {
 		billy.ReadCapability |
 		billy.ReadAndWriteCapability |
 		billy.SeekCapability |
-		billy.TruncateCapability
+		billy.TruncateCapability |
+		billy.LockCapability
 }
 
 // Name - return file name
@@ -283,15 +596,30 @@ func (f *File) Name() string {
 	return f.FileName
 }
 
-func (f *File) Read(b []byte) (int, error) {
-	f1, err := f.storage.GetFile(f.Path)
+func (f *File) Read(b []byte) (n int, err error) {
+	done := f.observe("Read")
+	defer func() { done(err) }()
 
-	if err != nil {
-		return 0, err
+	if f.IsClosed {
+		return 0, os.ErrClosed
+	}
+
+	// other handles could change the file, but buffered writes of this one
+	// aren't in db yet and its size is the latest one. The file is read by
+	// id, another file may have its path after a rename.
+	if len(f.buf) == 0 && !f.truncated {
+		f1, err := f.storage.GetFileByID(f.ID)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if f1 != nil {
+			f.Size = f1.Size
+		}
 	}
 
-	f.Content = f1.Content
-	n, err := f.ReadAt(b, f.Position)
+	n, err = f.ReadAt(b, f.Position)
 	f.Position += int64(n)
 
 	if err == io.EOF && n != 0 {
@@ -305,6 +633,9 @@ func (f *File) Read(b []byte) (int, error) {
 // underlying input source. It returns the number of bytes
 // read (0 <= n <= len(p)) and any error encountered.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	done := f.observe("ReadAt")
+	defer func() { done(err) }()
+
 	if f.IsClosed {
 		return 0, os.ErrClosed
 	}
@@ -313,41 +644,108 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 		return 0, errors.New("read not supported")
 	}
 
-	size := int64(len(f.Content))
-	if off >= size {
+	if off >= f.Size {
 		return 0, io.EOF
 	}
 
 	l := int64(len(b))
-	if off+l > size {
-		l = size - off
+	if off+l > f.Size {
+		l = f.Size - off
+		err = io.EOF
 	}
 
-	btr := f.Content[off : off+l]
-	if len(btr) < len(b) {
-		err = io.EOF
+	btr := b[:l]
+	bufEnd := f.bufOff + int64(len(f.buf))
+
+	// db isn't read if the buffer covers the whole range
+	if len(f.buf) == 0 || off < f.bufOff || off+l > bufEnd {
+		for i := range btr {
+			btr[i] = 0
+		}
+
+		if !f.truncated {
+			_, rerr := f.storage.ReadFileContentAt(f.ID, btr, off)
+
+			if rerr != nil && rerr != io.EOF {
+				return 0, rerr
+			}
+		}
 	}
-	n = copy(b, btr)
 
-	return n, err
+	if len(f.buf) != 0 && off < bufEnd && off+l > f.bufOff {
+		from := f.bufOff - off
+		if from < 0 {
+			copy(btr, f.buf[-from:])
+		} else {
+			copy(btr[from:], f.buf)
+		}
+	}
+
+	return int(l), err
 }
 
-func (f *File) WriteAt(p []byte) int {
-	off := f.Position
-	prev := len(f.Content)
+// WriteAt writes len(p) bytes from p to the file at offset off, like
+// io.WriterAt. The position of the file isn't changed.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	done := f.observe("WriteAt")
+	defer func() { done(err) }()
 
-	diff := int(off) - prev
+	if f.IsClosed {
+		return 0, os.ErrClosed
+	}
 
-	if diff > 0 {
-		f.Content = append(f.Content, make([]byte, diff)...)
+	if !isReadAndWrite(f.Flag) && !isWriteOnly(f.Flag) {
+		return 0, errors.New("write not supported")
 	}
 
-	f.Content = append(f.Content[:off], p...)
-	if len(f.Content) < prev {
-		f.Content = f.Content[:prev]
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n, err = f.writeAt(p, off)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.flushOver()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// writeAt writes p to the buffer of the file at offset off. If off isn't
+// inside or right after the buffered bytes, the buffer is flushed first.
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	bufEnd := f.bufOff + int64(len(f.buf))
+
+	if len(f.buf) != 0 && (off < f.bufOff || off > bufEnd) {
+		err := f.flush()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(f.buf) == 0 {
+		f.bufOff = off
+	}
+
+	start := off - f.bufOff
+	if end := start + int64(len(p)); end > int64(len(f.buf)) {
+		f.buf = append(f.buf, make([]byte, end-int64(len(f.buf)))...)
+	}
+
+	copy(f.buf[start:], p)
+
+	if end := off + int64(len(p)); end > f.Size {
+		f.Size = end
 	}
 
-	return len(p)
+	return len(p), nil
 }
 
 // Seek sets the offset for the next Read or Write to offset,
@@ -368,13 +766,16 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekStart:
 		f.Position = offset
 	case io.SeekEnd:
-		f.Position = int64(len(f.Content)) + offset
+		f.Position = f.Size + offset
 	}
 
 	return f.Position, nil
 }
 
-func (f *File) Write(p []byte) (int, error) {
+func (f *File) Write(p []byte) (n int, err error) {
+	done := f.observe("Write")
+	defer func() { done(err) }()
+
 	if f.IsClosed {
 		return 0, os.ErrClosed
 	}
@@ -383,10 +784,15 @@ func (f *File) Write(p []byte) (int, error) {
 		return 0, errors.New("write not supported")
 	}
 
-	n := f.WriteAt(p)
+	n, err = f.writeAt(p, f.Position)
+
+	if err != nil {
+		return 0, err
+	}
+
 	f.Position += int64(n)
 
-	err := f.storage.UpdateFileContent(f.ID, f.Content)
+	err = f.flushOver()
 
 	if err != nil {
 		return 0, err
@@ -395,69 +801,324 @@ func (f *File) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-// Close - implementation of the basic Close method.
-func (f *File) Close() error {
+// flushOver flushes the buffer if it has grown over the flush threshold
+func (f *File) flushOver() error {
+	if f.flushThreshold > 0 && len(f.buf) >= f.flushThreshold {
+		return f.flush()
+	}
+
+	return nil
+}
+
+// Sync saves the buffered content of the file to db
+func (f *File) Sync() (err error) {
+	done := f.observe("Sync")
+	defer func() { done(err) }()
+
 	if f.IsClosed {
 		return os.ErrClosed
 	}
 
-	f.IsClosed = true
+	return f.flush()
+}
+
+func (f *File) flush() error {
+	if !f.truncated && len(f.buf) == 0 {
+		return nil
+	}
+
+	err := f.update(func(s Storage) error {
+		if f.truncated {
+			err := s.TruncateFileContent(f.ID, 0)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(f.buf) == 0 {
+			return nil
+		}
+
+		return s.WriteFileContentAt(f.ID, f.buf, f.bufOff)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	f.truncated = false
+	f.buf = nil
+	f.bufOff = 0
 
 	return nil
 }
 
-// Truncate the file
-func (f *File) Truncate(size int64) error {
-	if size < int64(len(f.Content)) {
-		f.Content = f.Content[:size]
-	} else if more := int(size) - len(f.Content); more > 0 {
-		f.Content = append(f.Content, make([]byte, more)...)
+// update runs fn in a transaction if the content of the file wasn't changed
+// since the file read it, ErrConcurrentModification is returned otherwise.
+// Renames and metadata changes don't conflict with the buffered writes. The
+// file gets the content version updated by fn.
+func (f *File) update(fn func(s Storage) error) error {
+	return f.storage.Tx(func(s Storage) error {
+		err := s.SwapFileVersion(f.ID, f.ContentVersion)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(s)
+
+		if err != nil {
+			return err
+		}
+
+		f1, err := s.GetFileByID(f.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if f1 != nil {
+			f.ContentVersion = f1.ContentVersion
+		}
+
+		return nil
+	})
+}
+
+// Close saves the buffered content of the file to db and closes the file.
+func (f *File) Close() (err error) {
+	done := f.observe("Close")
+	defer func() { done(err) }()
+
+	if f.IsClosed {
+		return os.ErrClosed
+	}
+
+	err = f.flush()
+	f.IsClosed = true
+
+	if f.lockOwner != "" {
+		errUnlock := f.Unlock()
+
+		if err == nil {
+			err = errUnlock
+		}
+	}
+
+	return err
+}
+
+// Truncate changes the size of the file. The buffered content is flushed
+// and the new size is saved to db right away.
+func (f *File) Truncate(size int64) (err error) {
+	done := f.observe("Truncate")
+	defer func() { done(err) }()
+
+	if f.IsClosed {
+		return os.ErrClosed
+	}
+
+	err = f.flush()
+
+	if err != nil {
+		return err
 	}
 
+	err = f.update(func(s Storage) error {
+		return s.TruncateFileContent(f.ID, size)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	f.Size = size
+
 	return nil
 }
 
+// Duplicate returns a new handle of the file. The truncation of O_TRUNC is
+// saved right away, if it fails the handle saves it on the first flush.
 func (f *File) Duplicate(mode os.FileMode, flag int) billy.File {
+	new, _ := f.duplicate(mode, flag)
+	return new
+}
+
+// duplicate returns a new handle of the file and the error of saving the
+// truncation, the handle is returned also with the error
+func (f *File) duplicate(mode os.FileMode, flag int) (*File, error) {
 	new := &File{
 		ID:       f.ID,
 		ParentID: f.ParentID,
 		FileName: f.Name(),
 		Path:     f.Path,
 		Position: f.Position,
-		Content:  f.Content,
+		Size:     f.Size,
 		Mode:     mode,
 		Flag:     flag,
 		storage:  f.storage,
+
+		ModTime:    f.ModTime,
+		ChangeTime: f.ChangeTime,
+		UID:        f.UID,
+		GID:        f.GID,
+		Version:    f.Version,
+
+		ContentVersion: f.ContentVersion,
+		flushThreshold: f.flushThreshold,
+		lockExpiry:     f.lockExpiry,
+		observer:       f.observer,
+		ctx:            f.ctx,
 	}
 
 	if isAppend(flag) {
-		new.Position = int64(len(new.Content))
+		new.Position = new.Size
 	}
 
 	if isTruncate(flag) {
-		new.Content = make([]byte, 0)
+		new.Size = 0
+		new.truncated = true
+
+		// the file doesn't keep the old content in db until the first flush
+		return new, new.flush()
 	}
 
-	return new
+	return new, nil
+}
+
+// content reads the whole content of the file from db
+func (f *File) content() ([]byte, error) {
+	content := make([]byte, f.Size)
+
+	_, err := f.storage.ReadFileContentAt(f.ID, content, 0)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return content, nil
 }
 
 //Stat - get FileInfo from File
 func (f *File) Stat() (os.FileInfo, error) {
 	return &FileInfo{
-		FileName: f.Name(),
-		FileMode: f.Mode,
-		FileSize: int64(len(f.Content)),
+		FileID:         f.ID,
+		FileName:       f.Name(),
+		FileMode:       f.Mode,
+		FileSize:       f.Size,
+		FileModTime:    f.ModTime,
+		FileChangeTime: f.ChangeTime,
+		UID:            f.UID,
+		GID:            f.GID,
 	}, nil
 }
 
-// Lock is a no-op in db
-func (f *File) Lock() error {
+// Lock takes an exclusive advisory lock on the file, waiting while another
+// file holds it or until the context of the file is done. The lock is held
+// until Unlock or Close. It is renewed in background, so the lock of a
+// crashed process expires after Options.LockExpiry.
+func (f *File) Lock() (err error) {
+	done := f.observe("Lock")
+	defer func() { done(err) }()
+
+	if f.lockOwner != "" {
+		return nil
+	}
+
+	if f.lockExpiry <= 0 {
+		f.lockExpiry = DefaultLockExpiry
+	}
+
+	owner, err := newLockOwner()
+
+	if err != nil {
+		return err
+	}
+
+	ctx := contextOrBackground(f.ctx)
+
+	for {
+		ok, err := f.storage.TryLock(f.Path, owner, f.lockExpiry)
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			break
+		}
+
+		// the wait ends with the context of the file
+		t := time.NewTimer(LockRetryInterval)
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ErrCanceled
+		case <-t.C:
+		}
+	}
+
+	f.lockOwner = owner
+	f.lockDone = make(chan struct{})
+
+	// the holder of the lock sees the changes made before it was taken
+	if len(f.buf) == 0 && !f.truncated {
+		f1, err := f.storage.GetFile(f.Path)
+
+		if err != nil {
+			f.Unlock()
+			return err
+		}
+
+		if f1 != nil && f1.ID == f.ID {
+			f.Size = f1.Size
+			f.ContentVersion = f1.ContentVersion
+		}
+	}
+
+	go f.refreshLock(f.storage, f.Path, owner, f.lockDone)
+
 	return nil
 }
 
-// Unlock is a no-op in db
-func (f *File) Unlock() error {
-	return nil
+// refreshLock renews the lock until done is closed or the lock is lost.
+// The storage is passed by Lock, f.storage is changed by observed operations.
+func (f *File) refreshLock(s Storage, path, owner string, done chan struct{}) {
+	t := time.NewTicker(f.lockExpiry / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ok, err := s.RefreshLock(path, owner, f.lockExpiry)
+
+			if err == nil && !ok {
+				return
+			}
+		}
+	}
+}
+
+// Unlock releases the lock taken by Lock
+func (f *File) Unlock() (err error) {
+	done := f.observe("Unlock")
+	defer func() { done(err) }()
+
+	if f.lockOwner == "" {
+		return nil
+	}
+
+	close(f.lockDone)
+
+	owner := f.lockOwner
+	f.lockOwner = ""
+	f.lockDone = nil
+
+	return f.storage.Unlock(f.Path, owner)
 }
 
 func (fi *FileInfo) Name() string {
@@ -472,8 +1133,8 @@ func (fi *FileInfo) Mode() os.FileMode {
 	return fi.FileMode
 }
 
-func (*FileInfo) ModTime() time.Time {
-	return time.Now()
+func (fi *FileInfo) ModTime() time.Time {
+	return fi.FileModTime
 }
 
 func (fi *FileInfo) IsDir() bool {
@@ -484,6 +1145,9 @@ func (*FileInfo) Sys() interface{} {
 	return nil
 }
 
+// chmodMask - mode bits which can be changed by Chmod
+const chmodMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 func isSymlink(m os.FileMode) bool {
 	return m&os.ModeSymlink != 0
 }
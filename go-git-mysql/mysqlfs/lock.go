@@ -0,0 +1,99 @@
+package mysqlfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// LockRetryInterval - how often Lock retries to take a lock held by another
+// owner
+const LockRetryInterval = 50 * time.Millisecond
+
+// Locks are rows of the locks table. A lock is taken by inserting the row
+// and released by deleting it. The holder renews the expiry while the lock
+// is held, so the lock of a crashed holder expires and can be taken by
+// others. The lock queries join a running transaction, a connection outside
+// of it could wait for the transaction itself. Until the commit others wait
+// for the row of such a lock, which is released with the transaction.
+
+// TryLock takes the lock on the path for the owner if nobody else holds it,
+// an expired lock is taken over
+func (s *storage) TryLock(path, owner string, expiry time.Duration) (bool, error) {
+	path = clean(path)
+	now := time.Now()
+
+	err := s.ensureTables(lockTables...)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE namespace=? AND path=? AND expires<?", s.lockTableName),
+		s.namespace, path, now.UnixNano())
+
+	if err != nil {
+		return false, err
+	}
+
+	r, err := s.exec(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(namespace, path, owner, expires) VALUES(?,?,?,?)", s.lockTableName)),
+		s.namespace, path, owner, now.Add(expiry).UnixNano())
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// RefreshLock moves the expiry of the lock held by the owner, false means
+// the lock was lost. A lock taken in a transaction isn't refreshed, others
+// can't take it before the transaction ends.
+func (s *storage) RefreshLock(path, owner string, expiry time.Duration) (bool, error) {
+	if s.tx != nil {
+		return true, nil
+	}
+
+	r, err := s.exec(fmt.Sprintf("UPDATE %s SET expires=? WHERE namespace=? AND path=? AND owner=?", s.lockTableName),
+		time.Now().Add(expiry).UnixNano(), s.namespace, clean(path), owner)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// Unlock releases the lock held by the owner
+func (s *storage) Unlock(path, owner string) error {
+	_, err := s.exec(fmt.Sprintf("DELETE FROM %s WHERE namespace=? AND path=? AND owner=?", s.lockTableName),
+		s.namespace, clean(path), owner)
+
+	return err
+}
+
+// newLockOwner returns a random id of a lock holder
+func newLockOwner() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,742 @@
+package mysqlfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage - Storage keeping files in memory with the same semantics
+// as the db storage. It is meant for tests of code working with Mysqlfs.
+type memoryStorage struct {
+	*memoryState
+	// inTx - the storage is passed to the function run by Tx
+	inTx bool
+	// ctx - the methods fail with ErrCanceled after ctx is done
+	ctx context.Context
+}
+
+type memoryState struct {
+	mu sync.Mutex
+	// txMu - transactions are serialized
+	txMu sync.Mutex
+	// undo - the undo log of the running transaction
+	undo *memoryUndo
+
+	lastID int64
+	files  map[int64]*memoryFile
+	paths  map[string]int64
+	locks  map[string]memoryLock
+}
+
+// memoryUndo - the files and paths changed by a transaction as they were
+// before their first change, a nil file or a zero id didn't exist
+type memoryUndo struct {
+	files  map[int64]*memoryFile
+	paths  map[string]int64
+	lastID int64
+}
+
+type memoryFile struct {
+	FileDB
+	content []byte
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+// NewMemoryStorage creates an empty Storage keeping files in memory. Pass
+// it to NewWithStorage to get a filesystem which doesn't need db.
+// Transactions and writes of the storage are serialized, a failed
+// transaction reverts the changes made by it. Reads outside of the
+// transaction see its changes before it ends.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		memoryState: &memoryState{
+			files: map[int64]*memoryFile{},
+			paths: map[string]int64{},
+			locks: map[string]memoryLock{},
+		},
+		ctx: context.Background(),
+	}
+}
+
+// WithContext returns a view of the storage which fails with ErrCanceled
+// after ctx is done
+func (m *memoryStorage) WithContext(ctx context.Context) Storage {
+	return &memoryStorage{memoryState: m.memoryState, inTx: m.inTx, ctx: ctx}
+}
+
+// Close does nothing, the files are kept in memory until the storage is
+// garbage collected
+func (m *memoryStorage) Close() error {
+	return nil
+}
+
+// canceled returns ErrCanceled if the context of the storage is done
+func (m *memoryStorage) canceled() error {
+	if m.ctx.Err() != nil {
+		return ErrCanceled
+	}
+
+	return nil
+}
+
+func (m *memoryStorage) toFile(f *memoryFile) *File {
+	return fileDBtoFile(&f.FileDB, m)
+}
+
+func (m *memoryStorage) GetFile(path string) (*File, error) {
+	if err := m.canceled(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[m.paths[clean(path)]]
+
+	if !ok {
+		return nil, nil
+	}
+
+	return m.toFile(f), nil
+}
+
+func (m *memoryStorage) GetFileByID(id int64) (*File, error) {
+	if err := m.canceled(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[id]
+
+	if !ok {
+		return nil, nil
+	}
+
+	return m.toFile(f), nil
+}
+
+func (m *memoryStorage) GetFileID(path string) (int64, error) {
+	if err := m.canceled(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.paths[clean(path)], nil
+}
+
+func (m *memoryStorage) NewFile(path string, mode os.FileMode, flag int) (*File, error) {
+	path = clean(path)
+
+	var res *File
+
+	err := m.write(func(m *memoryStorage) error {
+		f, err := m.GetFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		if f != nil {
+			if !f.Mode.IsDir() {
+				return fmt.Errorf("file already exists %q", path)
+			}
+
+			return nil
+		}
+
+		parent, err := createParent(m, path, mode)
+
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, ok := m.paths[path]; ok {
+			return fmt.Errorf("file already exists %q", path)
+		}
+
+		now := time.Now().UnixNano()
+		m.lastID++
+
+		mf := &memoryFile{FileDB: FileDB{
+			ID:    m.lastID,
+			Name:  filepath.Base(path),
+			Path:  path,
+			Mode:  int64(mode),
+			Flag:  flag,
+			MTime: now,
+			CTime: now,
+		}}
+
+		if parent != nil {
+			mf.ParentID.Int64 = parent.ID
+			mf.ParentID.Valid = true
+		}
+
+		m.touch(mf.ID)
+		m.touchPath(path)
+		m.files[mf.ID] = mf
+		m.paths[path] = mf.ID
+		res = m.toFile(mf)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (m *memoryStorage) Children(path string) ([]*File, error) {
+	if err := m.canceled(); err != nil {
+		return nil, err
+	}
+
+	path = clean(path)
+
+	if path == "" || path == string(separator) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		return m.children(func(f *memoryFile) bool { return !f.ParentID.Valid }), nil
+	}
+
+	id, err := m.GetFileID(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if id == 0 {
+		return []*File{}, nil
+	}
+
+	return m.ChildrenByFileID(id)
+}
+
+func (m *memoryStorage) ChildrenByFileID(id int64) ([]*File, error) {
+	if err := m.canceled(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.children(func(f *memoryFile) bool { return f.ParentID.Valid && f.ParentID.Int64 == id }), nil
+}
+
+func (m *memoryStorage) ChildrenIdsByFileID(id int64) ([]int64, error) {
+	children, err := m.ChildrenByFileID(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]int64, 0, len(children))
+	for _, c := range children {
+		res = append(res, c.ID)
+	}
+
+	return res, nil
+}
+
+// children returns the files matching the filter in the order of ids, as
+// db returns them
+func (m *memoryStorage) children(filter func(f *memoryFile) bool) []*File {
+	res := make([]*File, 0)
+
+	for _, f := range m.files {
+		if filter(f) {
+			res = append(res, m.toFile(f))
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+func (m *memoryStorage) RenameFile(from, to string) error {
+	from = clean(from)
+	to = clean(to)
+
+	if from == to {
+		return nil
+	}
+
+	return m.write(func(m *memoryStorage) error {
+		f, err := m.GetFile(from)
+
+		if err != nil {
+			return err
+		}
+
+		if f == nil {
+			return os.ErrNotExist
+		}
+
+		if f.Mode.IsDir() && strings.HasPrefix(to, from+string(separator)) {
+			return fmt.Errorf("can't rename dir %q into its descendant %q", from, to)
+		}
+
+		target, err := m.GetFile(to)
+
+		if err != nil {
+			return err
+		}
+
+		if target != nil {
+			if f.Mode.IsDir() && !target.Mode.IsDir() {
+				return fmt.Errorf("can't replace file %q with dir %q", to, from)
+			}
+
+			if !f.Mode.IsDir() && target.Mode.IsDir() {
+				return fmt.Errorf("can't replace dir %q with file %q", to, from)
+			}
+
+			err = m.RemoveFile(to)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		newParentID, err := m.GetFileID(filepath.Dir(to))
+
+		if err != nil {
+			return err
+		}
+
+		if newParentID == 0 {
+			newParent, err := createParent(m, to, 0644)
+
+			if err != nil {
+				return err
+			}
+
+			if newParent != nil {
+				newParentID = newParent.ID
+			}
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		mf := m.files[f.ID]
+		m.touch(mf.ID)
+		mf.Name = filepath.Base(to)
+		mf.ParentID.Int64 = newParentID
+		mf.ParentID.Valid = newParentID != 0
+		mf.CTime = time.Now().UnixNano()
+		mf.Version++
+		m.move(mf, to)
+
+		if !f.Mode.IsDir() {
+			return nil
+		}
+
+		prefix := from + string(separator)
+		for _, c := range m.files {
+			if strings.HasPrefix(c.Path, prefix) {
+				m.touch(c.ID)
+				c.Version++
+				m.move(c, to+c.Path[len(from):])
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *memoryStorage) move(f *memoryFile, path string) {
+	m.touchPath(f.Path)
+	m.touchPath(path)
+	delete(m.paths, f.Path)
+	f.Path = path
+	m.paths[path] = f.ID
+}
+
+func (m *memoryStorage) RemoveFile(path string) error {
+	if err := m.canceled(); err != nil {
+		return err
+	}
+
+	path = clean(path)
+
+	return m.write(func(m *memoryStorage) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		f, ok := m.files[m.paths[path]]
+
+		if !ok {
+			return os.ErrNotExist
+		}
+
+		if os.FileMode(f.Mode).IsDir() && len(m.children(func(c *memoryFile) bool { return c.ParentID.Valid && c.ParentID.Int64 == f.ID })) != 0 {
+			return fmt.Errorf("dir: %s contains files", path)
+		}
+
+		m.touch(f.ID)
+		delete(m.files, f.ID)
+		delete(m.paths, path)
+
+		return nil
+	})
+}
+
+func (m *memoryStorage) CreateParentAddToFile(path string, mode os.FileMode, f *File) error {
+	return m.write(func(m *memoryStorage) error {
+		parent, err := createParent(m, path, mode)
+
+		if err != nil {
+			return err
+		}
+
+		if parent == nil {
+			return nil
+		}
+
+		f.ParentID = parent.ID
+
+		return m.update(f.ID, func(mf *memoryFile) {
+			mf.ParentID.Int64 = parent.ID
+			mf.ParentID.Valid = true
+		})
+	})
+}
+
+// update runs fn on the file with the id if it exists
+func (m *memoryStorage) update(fileID int64, fn func(f *memoryFile)) error {
+	if err := m.canceled(); err != nil {
+		return err
+	}
+
+	return m.write(func(m *memoryStorage) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if f, ok := m.files[fileID]; ok {
+			m.touch(fileID)
+			fn(f)
+			f.Version++
+		}
+
+		return nil
+	})
+}
+
+func (m *memoryStorage) UpdateFileContent(fileID int64, content []byte) error {
+	return m.update(fileID, func(f *memoryFile) {
+		f.content = append([]byte{}, content...)
+		f.Size = int64(len(content))
+		statsFromContext(m.ctx).addBytes(f.Size)
+		f.MTime = time.Now().UnixNano()
+		f.CTime = f.MTime
+		f.ContentVersion++
+	})
+}
+
+func (m *memoryStorage) UpdateFileMode(fileID int64, mode os.FileMode) error {
+	return m.update(fileID, func(f *memoryFile) {
+		f.Mode = int64(mode)
+		f.CTime = time.Now().UnixNano()
+	})
+}
+
+func (m *memoryStorage) UpdateFileOwner(fileID int64, uid, gid int) error {
+	return m.update(fileID, func(f *memoryFile) {
+		f.UID = uid
+		f.GID = gid
+		f.CTime = time.Now().UnixNano()
+	})
+}
+
+func (m *memoryStorage) UpdateFileModTime(fileID int64, mtime time.Time) error {
+	return m.update(fileID, func(f *memoryFile) {
+		f.MTime = mtime.UnixNano()
+		f.CTime = time.Now().UnixNano()
+	})
+}
+
+func (m *memoryStorage) ReadFileContentAt(fileID int64, p []byte, off int64) (int, error) {
+	if err := m.canceled(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[fileID]
+
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+
+	if off >= f.Size {
+		return 0, io.EOF
+	}
+
+	n := int64(len(p))
+	if off+n > f.Size {
+		n = f.Size - off
+	}
+
+	for i := range p[:n] {
+		p[i] = 0
+	}
+
+	if off < int64(len(f.content)) {
+		copy(p[:n], f.content[off:])
+	}
+
+	statsFromContext(m.ctx).addBytes(n)
+
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+
+	return int(n), nil
+}
+
+func (m *memoryStorage) WriteFileContentAt(fileID int64, p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return m.update(fileID, func(f *memoryFile) {
+		end := off + int64(len(p))
+
+		if int64(len(f.content)) < end {
+			f.content = append(f.content, make([]byte, end-int64(len(f.content)))...)
+		}
+
+		copy(f.content[off:], p)
+		statsFromContext(m.ctx).addBytes(int64(len(p)))
+
+		if end > f.Size {
+			f.Size = end
+		}
+
+		f.MTime = time.Now().UnixNano()
+		f.CTime = f.MTime
+		f.ContentVersion++
+	})
+}
+
+func (m *memoryStorage) TruncateFileContent(fileID int64, size int64) error {
+	return m.update(fileID, func(f *memoryFile) {
+		if int64(len(f.content)) > size {
+			f.content = f.content[:size]
+		}
+
+		f.Size = size
+		f.MTime = time.Now().UnixNano()
+		f.CTime = f.MTime
+		f.ContentVersion++
+	})
+}
+
+func (m *memoryStorage) SwapFileVersion(fileID, version int64) error {
+	if err := m.canceled(); err != nil {
+		return err
+	}
+
+	return m.write(func(m *memoryStorage) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		f, ok := m.files[fileID]
+
+		if !ok || f.ContentVersion != version {
+			return ErrConcurrentModification
+		}
+
+		m.touch(fileID)
+		f.Version++
+		f.ContentVersion++
+
+		return nil
+	})
+}
+
+func (m *memoryStorage) TryLock(path, owner string, expiry time.Duration) (bool, error) {
+	if err := m.canceled(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = clean(path)
+	now := time.Now()
+
+	if l, ok := m.locks[path]; ok && l.expires.After(now) {
+		return false, nil
+	}
+
+	m.locks[path] = memoryLock{owner: owner, expires: now.Add(expiry)}
+
+	return true, nil
+}
+
+func (m *memoryStorage) RefreshLock(path, owner string, expiry time.Duration) (bool, error) {
+	if err := m.canceled(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = clean(path)
+
+	if l, ok := m.locks[path]; !ok || l.owner != owner {
+		return false, nil
+	}
+
+	m.locks[path] = memoryLock{owner: owner, expires: time.Now().Add(expiry)}
+
+	return true, nil
+}
+
+func (m *memoryStorage) Unlock(path, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = clean(path)
+
+	if l, ok := m.locks[path]; ok && l.owner == owner {
+		delete(m.locks, path)
+	}
+
+	return nil
+}
+
+// Tx runs fn and reverts the changes made by it if fn fails. Calling Tx on
+// the storage passed to fn joins the running transaction.
+func (m *memoryStorage) Tx(fn func(s Storage) error) (err error) {
+	if err := m.canceled(); err != nil {
+		return err
+	}
+
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.mu.Lock()
+	m.undo = &memoryUndo{files: map[int64]*memoryFile{}, paths: map[string]int64{}, lastID: m.lastID}
+	m.mu.Unlock()
+
+	defer func() {
+		r := recover()
+		m.endTx(err != nil || r != nil)
+
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	return fn(&memoryStorage{memoryState: m.memoryState, inTx: true, ctx: m.ctx})
+}
+
+// write runs fn in the running transaction or in a new one, so the writes
+// made outside of transactions wait for the running one
+func (m *memoryStorage) write(fn func(m *memoryStorage) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	return m.Tx(func(s Storage) error {
+		return fn(s.(*memoryStorage))
+	})
+}
+
+// touch adds the file to the undo log of the running transaction before its
+// first change, m.mu must be held
+func (m *memoryStorage) touch(id int64) {
+	if m.undo == nil {
+		return
+	}
+
+	if _, ok := m.undo.files[id]; ok {
+		return
+	}
+
+	f, ok := m.files[id]
+
+	if !ok {
+		m.undo.files[id] = nil
+		return
+	}
+
+	c := *f
+	c.content = append([]byte(nil), f.content...)
+	m.undo.files[id] = &c
+	m.touchPath(f.Path)
+}
+
+// touchPath adds the path to the undo log of the running transaction before
+// its first change, m.mu must be held
+func (m *memoryStorage) touchPath(path string) {
+	if m.undo == nil {
+		return
+	}
+
+	if _, ok := m.undo.paths[path]; !ok {
+		m.undo.paths[path] = m.paths[path]
+	}
+}
+
+// endTx ends the running transaction, its changes are reverted by the undo
+// log if rollback is set
+func (m *memoryStorage) endTx(rollback bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.undo
+	m.undo = nil
+
+	if !rollback {
+		return
+	}
+
+	for id, f := range u.files {
+		if f == nil {
+			delete(m.files, id)
+		} else {
+			m.files[id] = f
+		}
+	}
+
+	for path, id := range u.paths {
+		if id == 0 {
+			delete(m.paths, path)
+		} else {
+			m.paths[path] = id
+		}
+	}
+
+	m.lastID = u.lastID
+}
@@ -47,6 +47,7 @@ func TestCommit(t *testing.T) {
 		t.Fatal(err)
 	}
 	f.Write([]byte("hello, go-git!"))
+	f.Close()
 
 	_, err = wt.Add("README.md")
 	if err != nil {
@@ -105,6 +106,7 @@ func TestLog(t *testing.T) {
 		t.Fatal(err)
 	}
 	f.Write([]byte("hello, go-git!"))
+	f.Close()
 
 	_, err = w.Add("README.md")
 	if err != nil {
@@ -1,30 +1,73 @@
 package mysqlfs
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/ujent/go-git-mysql/internal/testdb"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-billy.v4/util"
 )
 
-const connStr = "root:secret@/gogit"
 const tableName = "files"
 const tableName1 = "filesgit"
 
+// the tests run on an SQLite db in a temp file, see testdb for the dbs they
+// can run on
+var testDB = testdb.New("mysqlfs_test.db")
+
+var testDriver, connStr = testDB.Driver, testDB.DSN
+
+func TestMain(m *testing.M) {
+	os.Exit(testDB.Run(m))
+}
+
 func createDB(connStr string) (*sql.DB, error) {
-	db, err := sqlx.Connect("mysql", connStr)
+	return testDB.Connect(connStr)
+}
 
+func TestDetectDialect(t *testing.T) {
+	db, err := createDB(connStr)
 	if err != nil {
-		return nil, err
+		t.Error(err)
 	}
 
-	return db.DB, nil
+	must := MySQL
+	switch testDriver {
+	case testdb.SQLite:
+		must = SQLite
+	case testdb.Postgres:
+		must = PostgreSQL
+	}
+
+	if d := detectDialect(db); d != must {
+		t.Errorf("Wrong dialect. Must: %T, has: %T", must, d)
+	}
+}
+
+func TestDialectText(t *testing.T) {
+	// PostgreSQL can't infer the type of a bind variable passed to a string
+	// function, the other dbs don't need a cast
+	for d, must := range map[Dialect]string{MySQL: "CHAR_LENGTH(?)", PostgreSQL: "CHAR_LENGTH(CAST(? AS TEXT))", SQLite: "LENGTH(?)"} {
+		if has := d.CharLength(d.Text("?")); has != must {
+			t.Errorf("Wrong length of %T. Must: %s, has: %s", d, must, has)
+		}
+	}
 }
 
 func TestNewStorage(t *testing.T) {
@@ -33,7 +76,7 @@ func TestNewStorage(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = newStorage(db, tableName)
+	_, err = newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -76,7 +119,7 @@ func TestCreateParent(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -144,7 +187,7 @@ func TestStat(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -314,7 +357,7 @@ func TestSymlink(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -381,7 +424,7 @@ func TestGetFile(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -416,7 +459,7 @@ func TestGetFileID(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -449,7 +492,7 @@ func TestRenameFile1(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -497,7 +540,7 @@ func TestRenameFile2(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -545,7 +588,7 @@ func TestRenameFile3(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -593,7 +636,7 @@ func TestRenameFile4(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -617,6 +660,87 @@ func TestRenameFile4(t *testing.T) {
 
 	dropTable(connStr, tableName)
 }
+
+func TestRenameDir(t *testing.T) {
+	path1 := "/dir1/dir2/dir3/file1.txt"
+	_, err := createNewFile(path1)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err := newStorage(db, tableName, Options{})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = s.RenameFile("/dir1/dir2", "/dir4/dir5")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	f1, err := s.GetFile("/dir4/dir5/dir3/file1.txt")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if f1 == nil {
+		t.Fatal("Path of the grandchild wasn't changed")
+	}
+
+	dir, err := s.GetFile("/dir4/dir5")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	parentID, err := s.GetFileID("/dir4")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if dir.ParentID != parentID {
+		t.Errorf("Wrong parentID. Must: %d, has: %d", parentID, dir.ParentID)
+	}
+
+	children, err := s.Children("/dir1")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(children) != 0 {
+		t.Errorf("Moved dir is still a child of the old parent: %d", len(children))
+	}
+
+	err = s.RenameFile("/dir4", "/dir4/dir5/dir6")
+
+	if err == nil {
+		t.Error("Dir was renamed into its descendant")
+	}
+
+	f1, err = s.GetFile("/dir4/dir5/dir3/file1.txt")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if f1 == nil {
+		t.Error("Failed rename changed paths")
+	}
+
+	dropTable(connStr, tableName)
+}
+
 func TestRemoveFile1(t *testing.T) {
 	path := "/dir1/dir2/file1.txt"
 	_, err := createNewFile(path)
@@ -630,7 +754,7 @@ func TestRemoveFile1(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -668,7 +792,7 @@ func TestRemoveFile2(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -707,7 +831,7 @@ func TestRemoveFile3(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -741,7 +865,7 @@ func TestChildren1(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -781,7 +905,7 @@ func TestChildren2(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -814,7 +938,7 @@ func TestChildrenByFileID(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -858,7 +982,7 @@ func TestChildrenIdsByFileID(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -919,7 +1043,7 @@ func TestUpdateFileContent(t *testing.T) {
 		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
@@ -933,17 +1057,18 @@ func TestUpdateFileContent(t *testing.T) {
 		t.Error(err)
 	}
 
-	f1, err := s.GetFile(path)
+	b := make([]byte, len(c))
+	_, err = s.ReadFileContentAt(f.ID, b, 0)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if bytes.Equal(f.Content, f1.Content) {
-		t.Error("File content wasn't changed")
+	if !bytes.Equal(c, b) {
+		t.Errorf("Wrong content. Must: %s, has: %s", c, b)
 	}
 
-	c2 := []byte("222222")
+	c2 := []byte("222")
 
 	err = s.UpdateFileContent(f.ID, c2)
 
@@ -957,97 +1082,2827 @@ func TestUpdateFileContent(t *testing.T) {
 		t.Error(err)
 	}
 
-	if bytes.Equal(f.Content, f2.Content) {
-		t.Error("File content wasn't changed")
+	if f2.Size != int64(len(c2)) {
+		t.Errorf("Wrong size. Must: %d, has: %d", len(c2), f2.Size)
 	}
 
 	dropTable(connStr, tableName)
 }
 
-func TestReadWriteFile(t *testing.T) {
+func TestFileContentChunks(t *testing.T) {
+
+	path := "/dir1/dir2/file1.txt"
+	f, err := createNewFile(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
 	db, err := createDB(connStr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	fs, err := New(db, tableName)
+	s, err := newStorage(db, tableName, Options{})
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	path := "/dir1/file.txt"
+	c := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
 
-	f, err := fs.Create(path)
+	err = s.WriteFileContentAt(f.ID, c, 0)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	f1, err := fs.Open(path)
+	// overwrite the end of the first chunk and the beginning of the second one
+	err = s.WriteFileContentAt(f.ID, []byte("abcdef"), ChunkSize-3)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	str := "Hell0"
-	_, err = f.Write([]byte(str))
+	copy(c[ChunkSize-3:], "abcdef")
+
+	b := make([]byte, 10)
+	_, err = s.ReadFileContentAt(f.ID, b, ChunkSize-5)
+
 	if err != nil {
 		t.Error(err)
 	}
 
-	b := make([]byte, 5)
-	_, err = f1.Read(b)
-	if err != nil && err != io.EOF {
+	if !bytes.Equal(c[ChunkSize-5:ChunkSize+5], b) {
+		t.Errorf("Wrong content. Must: %s, has: %s", c[ChunkSize-5:ChunkSize+5], b)
+	}
+
+	chunks := 0
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_chunks WHERE fileID=?", tableName), f.ID).Scan(&chunks)
+
+	if err != nil {
 		t.Error(err)
 	}
 
-	if string(b) != str {
-		t.Errorf("Wrong content. Must: %s, has: %s ", str, string(b))
+	if chunks != 3 {
+		t.Errorf("Wrong chunks number. Must: %d, has: %d", 3, chunks)
+	}
+
+	err = s.TruncateFileContent(f.ID, ChunkSize+1)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	b = make([]byte, 10)
+	n, err := s.ReadFileContentAt(f.ID, b, ChunkSize-5)
+
+	if err != io.EOF {
+		t.Errorf("Wrong error. Must: %s, has: %v", io.EOF, err)
+	}
+
+	if n != 6 || !bytes.Equal(c[ChunkSize-5:ChunkSize+1], b[:n]) {
+		t.Errorf("Wrong content. Must: %s, has: %s", c[ChunkSize-5:ChunkSize+1], b[:n])
 	}
 
 	dropTable(connStr, tableName)
 }
 
-func createNewFile(path string) (*File, error) {
+func TestCompression(t *testing.T) {
 	db, err := createDB(connStr)
 	if err != nil {
-		return nil, err
+		t.Error(err)
 	}
 
-	s, err := newStorage(db, tableName)
+	fs, err := NewWithOptions(db, tableName, Options{Compression: Flate})
 
 	if err != nil {
-		return nil, err
+		t.Error(err)
 	}
 
-	f, err := s.NewFile(path, 0666, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	path := "/dir1/file.txt"
+	c := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
 
+	err = util.WriteFile(fs, path, c, 0666)
 	if err != nil {
-		return nil, err
+		t.Error(err)
 	}
 
-	return f, nil
+	fi, err := fs.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(c)) {
+		t.Errorf("Wrong size. Must: %d, has: %d", len(c), fi.Size())
+	}
+
+	var data []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT data FROM %s_chunks WHERE fileID=? AND chunkIndex=0", tableName), fi.(*FileInfo).FileID).Scan(&data)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(data) == 0 || data[0] != Flate.ID() || len(data) >= ChunkSize {
+		t.Errorf("Chunk wasn't compressed, size: %d", len(data))
+	}
+
+	// chunks written without compression are read together with the
+	// compressed ones
+	fs1, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	f, err := fs1.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Seek(ChunkSize-3, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f.Write([]byte("abcdef"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	f.Close()
+	copy(c[ChunkSize-3:], "abcdef")
+
+	content, err := readFile(fs, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Error("Wrong content")
+	}
+
+	// the ranged reads of the filesystem without compression fetch the
+	// compressed chunks whole
+	content, err = readFile(fs1, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Error("Wrong content read by ranges")
+	}
+
+	dropTable(connStr, tableName)
 }
 
-func connectToDB(connStr string) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("mysql", connStr)
+func TestRangedRead(t *testing.T) {
+	db, err := createDB(connStr)
 	if err != nil {
-		return nil, err
+		t.Error(err)
 	}
-	defer db.Close()
 
-	return db, nil
+	fs, err := New(db, tableName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+	c := make([]byte, 2*ChunkSize+ChunkSize/2)
+	for i := range c {
+		c[i] = byte(i % 251)
+	}
+
+	err = util.WriteFile(fs, path, c, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	f, err := fs.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	ranges := []struct{ off, n int64 }{
+		{0, 10},
+		{ChunkSize - 5, 10},
+		{ChunkSize + 7, 100},
+		{ChunkSize - 1, ChunkSize + 2},
+		{2*ChunkSize + ChunkSize/2 - 3, 3},
+	}
+
+	for _, r := range ranges {
+		b := make([]byte, r.n)
+
+		n, err := f.ReadAt(b, r.off)
+		if err != nil || int64(n) != r.n {
+			t.Errorf("Wrong read at %d: %d, %v", r.off, n, err)
+		}
+
+		if !bytes.Equal(c[r.off:r.off+r.n], b) {
+			t.Errorf("Wrong content at %d, length %d", r.off, r.n)
+		}
+	}
+
+	// io.Copy reads the file by small buffers
+	var buf bytes.Buffer
+
+	_, err = io.Copy(&buf, f)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, buf.Bytes()) {
+		t.Error("Wrong content copied")
+	}
+
+	dropTable(connStr, tableName)
 }
 
-func dropTable(connStr, tableName string) error {
-	db, err := sqlx.Connect("mysql", connStr)
+// testKeyProvider wraps data keys by xor with the current key encryption key
+type testKeyProvider struct {
+	current string
+	keks    map[string][]byte
+}
+
+func (kp *testKeyProvider) WrapKey(key []byte) ([]byte, string, error) {
+	return xor(key, kp.keks[kp.current]), kp.current, nil
+}
+
+func (kp *testKeyProvider) UnwrapKey(wrapped []byte, kekID string) ([]byte, error) {
+	kek, ok := kp.keks[kekID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kekID)
+	}
+
+	return xor(wrapped, kek), nil
+}
+
+func xor(p, key []byte) []byte {
+	res := make([]byte, len(p))
+	for i := range p {
+		res[i] = p[i] ^ key[i%len(key)]
+	}
+
+	return res
+}
+
+func TestEncryption(t *testing.T) {
+	db, err := createDB(connStr)
 	if err != nil {
-		return err
+		t.Error(err)
+	}
+
+	kp := &testKeyProvider{current: "kek1", keks: map[string][]byte{"kek1": []byte("secret1"), "kek2": []byte("secret2")}}
+	fs, err := NewWithOptions(db, tableName, Options{KeyProvider: kp, Compression: Gzip})
+
+	if err != nil {
+		t.Error(err)
 	}
-	defer db.Close()
 
-	db.MustExec(fmt.Sprintf("DROP TABLE %s", tableName))
+	path := "/dir1/file.txt"
+	c := bytes.Repeat([]byte("customer source code "), 100)
+
+	err = util.WriteFile(fs, path, c, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT data FROM %s_chunks WHERE fileID=? AND chunkIndex=0", tableName), fi.(*FileInfo).FileID).Scan(&data)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(data) == 0 || data[0] != encryptedChunk || bytes.Contains(data, []byte("customer")) {
+		t.Error("Chunk wasn't encrypted")
+	}
+
+	content, err := readFile(fs, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Error("Wrong content")
+	}
+
+	fs1, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = readFile(fs1, path)
+	if err != ErrNoKeyProvider {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrNoKeyProvider, err)
+	}
+
+	kp.current = "kek2"
+	mfs, _ := Unwrap(fs)
+
+	err = mfs.RotateKeys()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Reencrypt()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the old key encryption key isn't needed anymore
+	delete(kp.keks, "kek1")
+
+	fs2, err := NewWithOptions(db, tableName, Options{KeyProvider: kp})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err = readFile(fs2, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Error("Wrong content after rotation")
+	}
+
+	version := 0
+	err = db.QueryRow(fmt.Sprintf("SELECT data FROM %s_chunks WHERE fileID=? AND chunkIndex=0", tableName), fi.(*FileInfo).FileID).Scan(&data)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(data) > 5 {
+		version = int(data[4])
+	}
+
+	if version != 2 {
+		t.Errorf("Wrong data key version. Must: 2, has: %d", version)
+	}
+
+	// a sealed chunk can't be moved to another file
+	err = util.WriteFile(fs2, "/dir1/other.txt", []byte("other"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	other, err := fs2.Stat("/dir1/other.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("UPDATE %s_chunks SET data=? WHERE fileID=? AND chunkIndex=0", tableName), data, other.(*FileInfo).FileID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = readFile(fs2, "/dir1/other.txt")
+	if err == nil {
+		t.Error("Chunk moved to another file was decrypted")
+	}
+
+	err = fs2.Remove("/dir1/other.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the clone seals the content again for its namespace
+	err = CloneNamespace(db, tableName, "", "encrypted")
+	if err != ErrNoKeyProvider {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrNoKeyProvider, err)
+	}
+
+	err = CloneNamespaceWithOptions(db, tableName, "", "encrypted", Options{KeyProvider: kp})
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs3, err := NewWithOptions(db, tableName, Options{Namespace: "encrypted", KeyProvider: kp})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err = readFile(fs3, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Error("Wrong content of the clone")
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestReadWriteFile(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+
+	f, err := fs.Create(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	f1, err := fs.Open(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	str := "Hell0"
+	_, err = f.Write([]byte(str))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	b := make([]byte, 5)
+	_, err = f1.Read(b)
+	if err != nil && err != io.EOF {
+		t.Error(err)
+	}
+
+	if string(b) != str {
+		t.Errorf("Wrong content. Must: %s, has: %s ", str, string(b))
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestWriteBuffered(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Sync isn't a part of billy.File, so the file is opened without chroot
+	mfs, _ := Unwrap(fs)
+	path := "/dir1/file.txt"
+
+	f, err := mfs.Create(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	str := "Hell0"
+	_, err = f.Write([]byte(str))
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != 0 {
+		t.Errorf("Content was written before Close. Size: %d", fi.Size())
+	}
+
+	err = f.(*File).Sync()
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != int64(len(str)) {
+		t.Errorf("Wrong size after Sync. Must: %d, has: %d", len(str), fi.Size())
+	}
+
+	_, err = f.Write([]byte(str))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != int64(2*len(str)) {
+		t.Errorf("Wrong size after Close. Must: %d, has: %d", 2*len(str), fi.Size())
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestFlushThreshold(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{FlushThreshold: 4})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+
+	f, err := fs.Create(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f.Write([]byte("Hel"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != 0 {
+		t.Errorf("Content was written before threshold. Size: %d", fi.Size())
+	}
+
+	_, err = f.Write([]byte("l0"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != 5 {
+		t.Errorf("Wrong size after threshold. Must: %d, has: %d", 5, fi.Size())
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestTruncateOnOpen(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+
+	err = util.WriteFile(fs, path, []byte("Hell0"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Size() != 0 {
+		t.Errorf("File wasn't truncated. Size: %d", fi.Size())
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestModTime(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+
+	err = util.WriteFile(fs, path, []byte("Hell0"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi1, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi2, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !fi1.ModTime().Equal(fi2.ModTime()) {
+		t.Errorf("ModTime was changed without writes: %s, %s", fi1.ModTime(), fi2.ModTime())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	err = util.WriteFile(fs, path, []byte("Hell1"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi3, err := fs.Stat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !fi3.ModTime().After(fi1.ModTime()) {
+		t.Errorf("ModTime wasn't changed by write: %s, %s", fi1.ModTime(), fi3.ModTime())
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestChange(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	ch, ok := fs.(billy.Change)
+	if !ok {
+		t.Fatal("Filesystem doesn't implement billy.Change")
+	}
+
+	path := "/dir1/file.txt"
+	link := "/dir1/link"
+
+	err = util.WriteFile(fs, path, []byte("Hell0"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs.Symlink(path, link)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ch.Chmod(link, 0600)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mtime := time.Date(2019, 5, 20, 10, 0, 0, 0, time.UTC)
+
+	err = ch.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ch.Lchown(link, 1000, 1000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Lstat(path)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.Mode() != 0600 {
+		t.Errorf("Wrong mode. Must: %s, has: %s", os.FileMode(0600), fi.Mode())
+	}
+
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Wrong ModTime. Must: %s, has: %s", mtime, fi.ModTime())
+	}
+
+	if fi.(*FileInfo).UID != 0 {
+		t.Errorf("Owner of the link target was changed: %d", fi.(*FileInfo).UID)
+	}
+
+	fi, err = fs.Lstat(link)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fi.(*FileInfo).UID != 1000 || fi.(*FileInfo).GID != 1000 {
+		t.Errorf("Wrong owner. Must: %d:%d, has: %d:%d", 1000, 1000, fi.(*FileInfo).UID, fi.(*FileInfo).GID)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestTx(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		err := util.WriteFile(fs, "/dir1/file1.txt", []byte("Hell0"), 0666)
+		if err != nil {
+			return err
+		}
+
+		return fs.Rename("/dir1/file1.txt", "/dir2/file2.txt")
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fs.Stat("/dir2/file2.txt")
+	if err != nil {
+		t.Errorf("Committed file wasn't found: %s", err)
+	}
+
+	errRollback := errors.New("rollback")
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		err := util.WriteFile(fs, "/dir3/file3.txt", []byte("Hell0"), 0666)
+		if err != nil {
+			return err
+		}
+
+		err = fs.Remove("/dir2/file2.txt")
+		if err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+
+	if err != errRollback {
+		t.Errorf("Wrong error. Must: %s, has: %v", errRollback, err)
+	}
+
+	_, err = fs.Stat("/dir3")
+	if err != os.ErrNotExist {
+		t.Errorf("Rolled back dir exists: %v", err)
+	}
+
+	_, err = fs.Stat("/dir2/file2.txt")
+	if err != nil {
+		t.Errorf("Rolled back remove was applied: %s", err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestMemoryTx(t *testing.T) {
+	fs := NewWithStorage(NewMemoryStorage(), Options{})
+	mfs, _ := Unwrap(fs)
+	errRollback := errors.New("rollback")
+	done := make(chan error)
+
+	err := mfs.Tx(func(tfs billy.Filesystem) error {
+		err := util.WriteFile(tfs, "/file1.txt", []byte("Hello"), 0666)
+		if err != nil {
+			return err
+		}
+
+		// the write outside of the transaction waits for it and isn't
+		// reverted by its rollback
+		go func() {
+			done <- util.WriteFile(fs, "/file2.txt", []byte("World"), 0666)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		return errRollback
+	})
+
+	if err != errRollback {
+		t.Errorf("Wrong error. Must: %s, has: %v", errRollback, err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fs.Stat("/file1.txt")
+	if err != os.ErrNotExist {
+		t.Errorf("Rolled back file exists: %v", err)
+	}
+
+	content, err := readFile(fs, "/file2.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(content) != "World" {
+		t.Errorf("Wrong content. Must: World, has: %s", content)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs1, err := NewWithOptions(db, tableName, Options{Namespace: "repo1"})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs2, err := NewWithOptions(db, tableName, Options{Namespace: "repo2"})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file.txt"
+
+	err = util.WriteFile(fs1, path, []byte("Hell0"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs2, path, []byte("Hell0 again"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err := readFile(fs1, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(content) != "Hell0" {
+		t.Errorf("Namespaces aren't isolated. Must: Hell0, has: %s", content)
+	}
+
+	err = CreateNamespace(db, tableName, "repo1")
+	if err != ErrNamespaceExists {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrNamespaceExists, err)
+	}
+
+	err = CloneNamespace(db, tableName, "repo1", "repo3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs3, err := NewWithOptions(db, tableName, Options{Namespace: "repo3"})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err = readFile(fs3, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(content) != "Hell0" {
+		t.Errorf("Wrong content of the clone. Must: Hell0, has: %s", content)
+	}
+
+	// the snapshots and locks of a dropped namespace are removed with it
+	mfs1, _ := Unwrap(fs1)
+
+	err = mfs1.Snapshot("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	f, err := fs1.Create("/locked.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Lock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DropNamespace(db, tableName, "repo1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, suffix := range []string{"_snapshots", "_snapshot_files", "_snapshot_chunks", "_locks"} {
+		count := 0
+		err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s%s", tableName, suffix)).Scan(&count)
+		if err != nil || count != 0 {
+			t.Errorf("Rows of dropped namespace are left in %s: %d, %v", suffix, count, err)
+		}
+	}
+
+	n, err := CollectBlobs(db, tableName)
+	if err != nil || n == 0 {
+		t.Errorf("Blobs of dropped snapshots aren't collected: %d, %v", n, err)
+	}
+
+	namespaces, err := ListNamespaces(db, tableName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(namespaces) != 2 || namespaces[0] != "repo2" || namespaces[1] != "repo3" {
+		t.Errorf("Wrong namespaces. Must: [repo2 repo3], has: %v", namespaces)
+	}
+
+	_, err = fs3.Stat(path)
+	if err != nil {
+		t.Errorf("Dropping the source removed the clone: %s", err)
+	}
+
+	// a file whose parent doesn't exist isn't cloned as a root file
+	sdb := sqlx.NewDb(db, testDriver)
+	sdb.MustExec(sdb.Rebind(fmt.Sprintf("UPDATE %s SET parentID=? WHERE namespace=? AND path=?", tableName)), 9999, "repo3", path)
+
+	err = CloneNamespace(db, tableName, "repo3", "repo4")
+	if err == nil {
+		t.Error("Namespace with an orphan was cloned")
+	}
+
+	namespaces, err = ListNamespaces(db, tableName)
+	if err != nil || len(namespaces) != 2 {
+		t.Errorf("Failed clone left a namespace: %v, %v", namespaces, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestLock(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{LockExpiry: 300 * time.Millisecond})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/index"
+
+	f1, err := fs.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := fs.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f1.Lock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		locked <- f2.Lock()
+	}()
+
+	// the lock is renewed, so it doesn't expire while f1 holds it
+	select {
+	case <-locked:
+		t.Error("File was locked twice")
+	case <-time.After(time.Second):
+	}
+
+	err = f1.Unlock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock wasn't released")
+	}
+
+	err = f2.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	f1.Close()
+
+	// a holder which crashed doesn't renew its lock
+	mfs, _ := Unwrap(fs)
+	s := mfs.storage.(*storage)
+
+	ok, err := s.TryLock(path, "crashed", 300*time.Millisecond)
+	if err != nil || !ok {
+		t.Errorf("Lock wasn't taken: %v", err)
+	}
+
+	f3, err := fs.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	err = f3.Lock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Lock of the crashed holder was taken before expiry")
+	}
+
+	f3.Close()
+
+	// a waiting Lock ends with the context of the file
+	ok, err = s.TryLock(path, "other", time.Minute)
+	if err != nil || !ok {
+		t.Errorf("Lock wasn't taken: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f4, err := mfs.WithContext(ctx).Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err = f4.Lock()
+	if err != ErrCanceled {
+		t.Errorf("Wrong error of canceled lock: %v", err)
+	}
+
+	err = s.Unlock(path, "other")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a Lock in a transaction doesn't wait for the transaction
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		err := util.WriteFile(fs, "/dir1/other", []byte("abc"), 0666)
+		if err != nil {
+			return err
+		}
+
+		f, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+
+		err = f.Lock()
+		if err != nil {
+			return err
+		}
+
+		if time.Since(start) > 5*time.Second {
+			t.Error("Lock waited for the transaction")
+		}
+
+		return f.Close()
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	ok, err = s.TryLock(path, "other", time.Minute)
+	if err != nil || !ok {
+		t.Errorf("Lock of the transaction wasn't released: %v", err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestCache(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs1, err := NewWithOptions(db, tableName, Options{CacheSize: 2})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs2, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/dir1/file1.txt"
+
+	err = util.WriteFile(fs1, path, []byte("Hell0"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs1.Stat(path)
+	if err != nil || fi.Mode() != 0666 {
+		t.Errorf("Wrong stat: %v, %v", fi, err)
+	}
+
+	// the changes made by another filesystem must be seen through the cache
+	mfs2, _ := Unwrap(fs2)
+
+	err = mfs2.Chmod(path, 0600)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs1.Stat(path)
+	if err != nil || fi.Mode() != 0600 {
+		t.Errorf("Stale mode from cache: %v, %v", fi, err)
+	}
+
+	err = util.WriteFile(fs2, path, []byte("Hello world"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs1.Stat(path)
+	if err != nil || fi.Size() != 11 {
+		t.Errorf("Stale size from cache: %v, %v", fi, err)
+	}
+
+	err = fs2.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fs1.Stat(path)
+	if err != os.ErrNotExist {
+		t.Errorf("Removed file was found in cache: %v", err)
+	}
+
+	err = util.WriteFile(fs2, path, []byte("Hi"), 0644)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fi, err = fs1.Stat(path)
+	if err != nil || fi.Mode() != 0644 || fi.Size() != 2 {
+		t.Errorf("Wrong stat of recreated file: %v, %v", fi, err)
+	}
+
+	mfs, _ := Unwrap(fs1)
+	c := mfs.storage.(*storage).cache
+
+	if c.order.Len() > 2 {
+		t.Errorf("Cache exceeds its size: %d", c.order.Len())
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestCheck(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a mistyped table isn't created
+	_, err = Check(db, "missing")
+	if err != ErrTableNotFound {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrTableNotFound, err)
+	}
+
+	_, err = PurgeDeleted(db, "missing", 0)
+	if err != ErrTableNotFound {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrTableNotFound, err)
+	}
+
+	missing, err := openStorage(db, "missing", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := missing.hasTable("")
+	if exists || err != nil {
+		t.Errorf("Table was created: %v", err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, path := range []string{"/dir1/file1.txt", "/dir2/file2.txt", "/file3.txt", "/dir3/file4.txt"} {
+		err = util.WriteFile(fs, path, []byte("Hell0"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := Check(db, tableName)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Problems in consistent table: %v, %v", problems, err)
+	}
+
+	s := unwrapStorage(t, fs).(*storage)
+	dir2, _ := s.GetFile("/dir2")
+
+	s.db.MustExec(s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE path=?", tableName)), "/dir1")
+	s.db.MustExec(s.db.Rebind(fmt.Sprintf("UPDATE %s SET parentID=? WHERE path=?", tableName)), dir2.ID, "/file3.txt")
+	s.db.MustExec(s.db.Rebind(fmt.Sprintf("UPDATE %s SET parentID=? WHERE path=?", tableName)), 9999, "/dir2/file2.txt")
+	s.db.MustExec(s.db.Rebind(fmt.Sprintf("UPDATE %s SET name=? WHERE path=?", tableName)), "file5.txt", "/dir3/file4.txt")
+
+	problems, err = Check(db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	has := map[Problem]bool{}
+	for _, p := range problems {
+		has[Problem{Kind: p.Kind, Path: p.Path}] = true
+	}
+
+	must := []Problem{
+		{Kind: ProblemMissingDir, Path: "/dir1/file1.txt"},
+		{Kind: ProblemDanglingParent, Path: "/dir1/file1.txt"},
+		{Kind: ProblemRootWithParent, Path: "/file3.txt"},
+		{Kind: ProblemDanglingParent, Path: "/dir2/file2.txt"},
+		{Kind: ProblemPathMismatch, Path: "/dir3/file4.txt"},
+	}
+
+	if len(problems) != len(must) {
+		t.Errorf("Wrong problems: %v", problems)
+	}
+
+	for _, p := range must {
+		if !has[p] {
+			t.Errorf("Problem wasn't found: %s", p)
+		}
+	}
+
+	problems, err = Repair(db, tableName, RepairRebuildParents)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Problems after repair: %v, %v", problems, err)
+	}
+
+	dir1, _ := s.GetFile("/dir1")
+	file1, _ := s.GetFile("/dir1/file1.txt")
+	if dir1 == nil || !dir1.Mode.IsDir() || file1.ParentID != dir1.ID {
+		t.Errorf("Missing dir wasn't rebuilt: %v, %v", dir1, file1)
+	}
+
+	infos, err := fs.ReadDir("/")
+	if err != nil || len(infos) != 4 {
+		t.Errorf("Wrong ReadDir of root after repair: %v, %v", infos, err)
+	}
+
+	s.db.MustExec(s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE path=?", tableName)), "/dir1")
+
+	problems, err = Repair(db, tableName, RepairQuarantine)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Problems after repair: %v, %v", problems, err)
+	}
+
+	if _, err = fs.Stat("/dir1"); err != os.ErrNotExist {
+		t.Errorf("Quarantined dir was rebuilt: %v", err)
+	}
+
+	content, err := readFile(fs, fmt.Sprintf("%s/%d_file1.txt", QuarantineDir, file1.ID))
+	if string(content) != "Hell0" || err != nil {
+		t.Errorf("Orphan wasn't quarantined: %q, %v", content, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestExportImport(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	mtime := time.Date(2019, 5, 20, 10, 0, 0, 0, time.UTC)
+
+	err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Hell0"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Symlink("file1.txt", "/dir1/link1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mfs.Chtimes("/dir1/file1.txt", mtime, mtime)
+	if err != nil {
+		t.Error(err)
+	}
+
+	linkTime := mtime.Add(time.Hour)
+
+	err = mfs.Lchtimes("/dir1/link1", linkTime, linkTime)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var b bytes.Buffer
+
+	err = Export(fs, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewWithStorage(NewMemoryStorage(), Options{})
+
+	err = Import(dst, bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := readFile(dst, "/dir1/link1")
+	if string(content) != "Hell0" || err != nil {
+		t.Errorf("Wrong imported content: %q, %v", content, err)
+	}
+
+	fi, err := dst.Lstat("/dir1/file1.txt")
+	if err != nil || fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Wrong imported file: %v, %v", fi, err)
+	}
+
+	target, err := dst.Readlink("/dir1/link1")
+	if target != "file1.txt" || err != nil {
+		t.Errorf("Wrong imported link: %q, %v", target, err)
+	}
+
+	fi, err = dst.Lstat("/dir1/link1")
+	if err != nil || !fi.ModTime().Equal(linkTime) {
+		t.Errorf("Wrong imported link time: %v, %v", fi, err)
+	}
+
+	// tar -C dir . writes the root as "./"
+	var root bytes.Buffer
+	tw := tar.NewWriter(&root)
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "./file3.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("Hello"))
+	tw.Close()
+
+	dst = NewWithStorage(NewMemoryStorage(), Options{})
+
+	err = Import(dst, &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := dst.ReadDir("/")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "file3.txt" {
+		t.Errorf("Wrong imported root: %v, %v", infos, err)
+	}
+
+	// a broken stream imports nothing
+	err = Import(fs, bytes.NewReader(b.Bytes()[:1027]))
+	if err == nil {
+		t.Error("Broken stream was imported")
+	}
+
+	dir, err := ioutil.TempDir("", "mysqlfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = Copy(fs, osfs.New(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	osfi, err := os.Stat(filepath.Join(dir, "dir1", "file1.txt"))
+	if err != nil || osfi.Mode() != 0640 || !osfi.ModTime().Equal(mtime) {
+		t.Errorf("Wrong copied file: %v, %v", osfi, err)
+	}
+
+	err = util.WriteFile(osfs.New(dir), "/dir2/file2.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Copy(osfs.New(dir), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err = readFile(fs, "/dir2/file2.txt")
+	if string(content) != "Hello" || err != nil {
+		t.Errorf("Wrong copied content: %q, %v", content, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithContext(context.Background(), db, tableName, Options{})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Hell0"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = NewWithOptions(db, tableName, Options{QueryTimeout: time.Nanosecond})
+
+	if err == nil {
+		_, err = fs.Stat("/dir1/file1.txt")
+	}
+
+	if err != ErrQueryTimeout {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrQueryTimeout, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestRetry(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	retries := []int{}
+	policy := DefaultRetryPolicy
+	policy.MinBackoff = time.Millisecond
+	policy.MaxRetries = 3
+	policy.OnRetry = func(retry int, err error) {
+		retries = append(retries, retry)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{Retry: policy})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	calls := 0
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		err := util.WriteFile(fs, fmt.Sprintf("/dir1/file%d.txt", calls), []byte("Hell0"), 0666)
+		if err != nil {
+			return err
+		}
+
+		calls++
+		if calls < 3 {
+			return &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(retries) != 2 || retries[1] != 2 {
+		t.Errorf("Wrong retries: %v", retries)
+	}
+
+	// only the replay which succeeded is committed
+	infos, err := fs.ReadDir("/dir1")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "file2.txt" {
+		t.Errorf("Wrong files after retries: %v, %v", infos, err)
+	}
+
+	calls = 0
+	errPermanent := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		calls++
+		return errPermanent
+	})
+
+	if err != errPermanent || calls != 1 {
+		t.Errorf("Permanent error was retried: %d, %v", calls, err)
+	}
+
+	calls = 0
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		calls++
+		return driver.ErrBadConn
+	})
+
+	if err != driver.ErrBadConn || calls != 4 {
+		t.Errorf("Wrong number of attempts: %d, %v", calls, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestTableName(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"files; DROP TABLE files", "files`", "1files", "files-1", strings.Repeat("f", 49)} {
+		_, err = New(db, name)
+		if err != ErrInvalidTableName {
+			t.Errorf("Wrong error of table name %q: %v", name, err)
+		}
+	}
+
+	// reserved words can be used as quoted names
+	fs, err := New(db, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err := readFile(fs, "/dir1/file1.txt")
+	if string(content) != "Hello" || err != nil {
+		t.Errorf("Wrong content: %q, %v", content, err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	mfs.Close()
+
+	err = DropTables(db, "group")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateTable(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the files table of the first version kept the content in its rows
+	legacy := "CREATE TABLE files (id INTEGER PRIMARY KEY AUTOINCREMENT, parentID BIGINT, name varchar(255) NOT NULL, " +
+		"path varchar(255) NOT NULL, flag INT, mode BIGINT, content BLOB)"
+	if testDriver == testdb.MySQL {
+		legacy = "CREATE TABLE files (id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY, parentID BIGINT, name varchar(255) NOT NULL, " +
+			"path varchar(255) NOT NULL, flag INT, mode BIGINT, content LONGBLOB, UNIQUE (path), INDEX (path), INDEX (parentID))"
+	}
+
+	sdb := sqlx.NewDb(db, testDriver)
+	sdb.MustExec(legacy)
+	defer dropTable(connStr, tableName)
+
+	content := bytes.Repeat([]byte("Hello"), ChunkSize/3)
+
+	r := sdb.MustExec(sdb.Rebind("INSERT INTO files(name, path, flag, mode) VALUES(?,?,?,?)"), "dir1", "/dir1", 0, int64(os.ModeDir|0755))
+	dirID, _ := r.LastInsertId()
+	sdb.MustExec(sdb.Rebind("INSERT INTO files(parentID, name, path, flag, mode, content) VALUES(?,?,?,?,?,?)"),
+		dirID, "file1.txt", "/dir1/file1.txt", os.O_RDWR, 0666, content)
+
+	// the tools don't upgrade the table
+	_, err = Check(db, tableName)
+	if err != ErrTableOutdated {
+		t.Errorf("Wrong error. Must: %s, has: %v", ErrTableOutdated, err)
+	}
+
+	fs, err := New(db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readFile(fs, "/dir1/file1.txt")
+	if !bytes.Equal(got, content) || err != nil {
+		t.Errorf("Wrong content after migration: %d bytes, %v", len(got), err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	columns, err := mfs.storage.(*storage).tableColumns(tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if columns["content"] || !columns["namespace"] || !columns["version"] || !columns["deleted_at"] {
+		t.Errorf("Wrong columns after migration: %v", columns)
+	}
+
+	// other namespaces can have the same paths
+	nfs, err := NewWithOptions(db, tableName, Options{Namespace: "ns1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = util.WriteFile(nfs, "/dir1/file1.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFeatureTables(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := New(db, tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dropTable(connStr, tableName)
+
+	mfs, _ := Unwrap(fs)
+	s := mfs.storage.(*storage)
+
+	tables := func() []string {
+		var res []string
+		for _, tbl := range s.tables() {
+			columns, err := s.tableColumns(tableName + tbl.suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(columns) != 0 {
+				res = append(res, tbl.suffix)
+			}
+		}
+
+		return res
+	}
+
+	if res := tables(); fmt.Sprint(res) != fmt.Sprint([]string{"", "_chunks"}) {
+		t.Errorf("Wrong tables of a filesystem without features: %q", res)
+	}
+
+	f, err := fs.Create("/dir1/file1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Lock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	f.Unlock()
+	f.Close()
+
+	err = mfs.Snapshot("snap1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if res := tables(); fmt.Sprint(res) != fmt.Sprint([]string{"", "_chunks", "_locks", "_snapshots", "_snapshot_files", "_snapshot_chunks", "_blobs"}) {
+		t.Errorf("Wrong tables after Lock and Snapshot: %q", res)
+	}
+
+	// the tools don't need the tables of unused features
+	n, err := CollectBlobs(db, tableName)
+	if n != 0 || err != nil {
+		t.Errorf("Wrong CollectBlobs: %d, %v", n, err)
+	}
+
+	n, err = TrimChanges(db, tableName, 0)
+	if n != 0 || err != nil {
+		t.Errorf("Wrong TrimChanges: %d, %v", n, err)
+	}
+
+	names, err := ListNamespaces(db, tableName)
+	if len(names) != 0 || err != nil {
+		t.Errorf("Wrong ListNamespaces: %v, %v", names, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := New(db, tableName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	s := mfs.storage.(*storage)
+
+	for i := 0; i < 3; i++ {
+		err = util.WriteFile(fs, fmt.Sprintf("/dir1/file%d.txt", i), []byte("Hello"), 0666)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the statements are prepared once and reused by all the writes
+	n := len(s.stmts.m)
+
+	err = util.WriteFile(fs, "/dir1/file3.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if n == 0 || len(s.stmts.m) != n {
+		t.Errorf("Statements weren't reused: %d, %d", n, len(s.stmts.m))
+	}
+
+	view := mfs.WithContext(context.Background())
+
+	err = mfs.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fs.Stat("/dir1/file1.txt")
+	if err != ErrClosed {
+		t.Errorf("Wrong error after Close: %v", err)
+	}
+
+	_, err = view.Stat("/dir1/file1.txt")
+	if err != ErrClosed {
+		t.Errorf("Wrong error of view after Close: %v", err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestSoftDelete(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{SoftDelete: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	path := "/dir1/file1.txt"
+
+	err = util.WriteFile(fs, path, []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fs.Stat(path)
+	if err != os.ErrNotExist {
+		t.Errorf("Deleted file is visible: %v", err)
+	}
+
+	infos, err := fs.ReadDir("/dir1")
+	if err != nil || len(infos) != 0 {
+		t.Errorf("Deleted file is listed: %v, %v", infos, err)
+	}
+
+	// the path of the deleted file can be used again
+	err = util.WriteFile(fs, path, []byte("Hello world"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	deleted, err := mfs.ListDeleted()
+	if err != nil || len(deleted) != 2 || deleted[0].Path != path || deleted[0].Size != 11 || deleted[1].Size != 5 {
+		t.Fatalf("Wrong deleted files: %+v, %v", deleted, err)
+	}
+
+	// deleted files aren't found by their trash paths
+	cfs, err := NewWithOptions(db, tableName, Options{SoftDelete: true, CacheSize: 10})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cmfs, _ := Unwrap(cfs)
+
+	for _, d := range deleted {
+		f, err := mfs.storage.GetFile(trashPath(d.ID))
+		if f != nil || err != nil {
+			t.Errorf("Deleted file was found: %+v, %v", f, err)
+		}
+
+		id, err := mfs.storage.GetFileID(trashPath(d.ID))
+		if id != 0 || err != nil {
+			t.Errorf("Id of deleted file was found: %d, %v", id, err)
+		}
+
+		f, err = cmfs.storage.GetFile(trashPath(d.ID))
+		if f != nil || err != nil {
+			t.Errorf("Deleted file was found through cache: %+v, %v", f, err)
+		}
+	}
+
+	err = mfs.Undelete(deleted[1].ID, "/dir2/restored.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Undelete(deleted[0].ID, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Undelete(deleted[0].ID, "")
+	if err != os.ErrNotExist {
+		t.Errorf("Wrong error of restored file: %v", err)
+	}
+
+	for p, c := range map[string]string{path: "Hello world", "/dir2/restored.txt": "Hello"} {
+		content, err := readFile(fs, p)
+		if string(content) != c || err != nil {
+			t.Errorf("Wrong content of %s: %q, %v", p, content, err)
+		}
+	}
+
+	// a removed tree is restored as it was at the time
+	since := time.Now()
+
+	for _, p := range []string{path, "/dir1", "/dir2/restored.txt"} {
+		err = fs.Remove(p)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	problems, err := Check(db, tableName)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Deleted files are inconsistent: %v, %v", problems, err)
+	}
+
+	n, err := mfs.UndeleteSince(since)
+	if err != nil || n != 3 {
+		t.Errorf("Wrong number of restored files: %d, %v", n, err)
+	}
+
+	content, err := readFile(fs, path)
+	if string(content) != "Hello world" || err != nil {
+		t.Errorf("Wrong content after restore: %q, %v", content, err)
+	}
+
+	err = fs.Remove("/dir2/restored.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	n1, err := PurgeDeleted(db, tableName, time.Hour)
+	if err != nil || n1 != 0 {
+		t.Errorf("Recently deleted files were purged: %d, %v", n1, err)
+	}
+
+	n1, err = PurgeDeleted(db, tableName, 0)
+	if err != nil || n1 != 1 {
+		t.Errorf("Wrong number of purged files: %d, %v", n1, err)
+	}
+
+	deleted, err = mfs.ListDeleted()
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("Trash isn't empty: %+v, %v", deleted, err)
+	}
+
+	chunks := 0
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_chunks", tableName)).Scan(&chunks)
+	if err != nil || chunks != 1 {
+		t.Errorf("Wrong number of chunks after purge: %d, %v", chunks, err)
+	}
+
+	// without the option files are deleted right away
+	fs1, err := New(db, tableName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs1.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs1, _ := Unwrap(fs1)
+
+	deleted, err = mfs1.ListDeleted()
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("File was moved to trash: %+v, %v", deleted, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestSnapshot(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{Namespace: "repo1"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	for p, c := range map[string]string{"/dir1/file1.txt": "Hello", "/dir1/file2.txt": "Hello world", "/file3.txt": "Hi"} {
+		err = util.WriteFile(fs, p, []byte(c), 0666)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = mfs.Snapshot("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Snapshot("first")
+	if err != ErrSnapshotExists {
+		t.Errorf("Wrong error of existing snapshot: %v", err)
+	}
+
+	err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Changed"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Snapshot("second")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the unchanged content is shared by the snapshots
+	blobs := 0
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_blobs", tableName)).Scan(&blobs)
+	if err != nil || blobs != 4 {
+		t.Errorf("Wrong number of blobs: %d, %v", blobs, err)
+	}
+
+	snapshots, err := mfs.ListSnapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[0].Name != "first" || snapshots[1].Name != "second" {
+		t.Errorf("Wrong snapshots: %+v, %v", snapshots, err)
+	}
+
+	err = fs.Remove("/dir1/file2.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/file4.txt", []byte("New"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a file opened before the restore can't save its writes
+	f, err := fs.OpenFile("/file3.txt", os.O_RDWR, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Restore("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f.Write([]byte("Stale"))
+	if err == nil {
+		err = f.Close()
+	}
+
+	if err != ErrConcurrentModification {
+		t.Errorf("Wrong error of stale file: %v", err)
+	}
+
+	for p, c := range map[string]string{"/dir1/file1.txt": "Hello", "/dir1/file2.txt": "Hello world", "/file3.txt": "Hi"} {
+		content, err := readFile(fs, p)
+		if string(content) != c || err != nil {
+			t.Errorf("Wrong content of %s: %q, %v", p, content, err)
+		}
+	}
+
+	_, err = fs.Stat("/file4.txt")
+	if err != os.ErrNotExist {
+		t.Errorf("File created after snapshot exists: %v", err)
+	}
+
+	problems, err := Check(db, tableName)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Restored files are inconsistent: %v, %v", problems, err)
+	}
+
+	// the restored files can be changed
+	err = util.WriteFile(fs, "/dir1/file2.txt", []byte("Bye"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Restore("second")
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err := readFile(fs, "/dir1/file1.txt")
+	if string(content) != "Changed" || err != nil {
+		t.Errorf("Wrong content after restore: %q, %v", content, err)
+	}
+
+	err = mfs.DropSnapshot("second")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_blobs", tableName)).Scan(&blobs)
+	if err != nil || blobs != 3 {
+		t.Errorf("Wrong number of blobs after drop: %d, %v", blobs, err)
+	}
+
+	err = mfs.Restore("second")
+	if err != ErrSnapshotNotFound {
+		t.Errorf("Wrong error of dropped snapshot: %v", err)
+	}
+
+	// snapshots of other namespaces aren't visible
+	fs1, err := NewWithOptions(db, tableName, Options{Namespace: "repo2"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs1, _ := Unwrap(fs1)
+
+	snapshots, err = mfs1.ListSnapshots()
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("Snapshots of other namespace are listed: %+v, %v", snapshots, err)
+	}
+
+	err = mfs.DropSnapshot("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_blobs", tableName)).Scan(&blobs)
+	if err != nil || blobs != 0 {
+		t.Errorf("Wrong number of blobs after drop: %d, %v", blobs, err)
+	}
+
+	mfs2, _ := Unwrap(NewWithStorage(NewMemoryStorage(), Options{}))
+
+	err = mfs2.Snapshot("first")
+	if err != ErrSnapshotsUnsupported {
+		t.Errorf("Wrong error of memory storage: %v", err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestDedup(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs1, err := NewWithOptions(db, tableName, Options{Namespace: "fork1", Dedup: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs2, err := NewWithOptions(db, tableName, Options{Namespace: "fork2", Dedup: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	path := "/objects/pack/pack-1.pack"
+	c := []byte(strings.Repeat("0123456789", ChunkSize/4))
+
+	for _, fs := range []billy.Filesystem{fs1, fs2} {
+		err = util.WriteFile(fs, path, c, 0666)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	blobs := 0
+	refs := 0
+
+	count := func() {
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(refs), 0) FROM %s_blobs", tableName)).Scan(&blobs, &refs)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the content of both files is stored once
+	count()
+	if blobs != 3 || refs != 6 {
+		t.Errorf("Wrong blobs: %d, refs: %d", blobs, refs)
+	}
+
+	for _, fs := range []billy.Filesystem{fs1, fs2} {
+		content, err := readFile(fs, path)
+		if !bytes.Equal(content, c) || err != nil {
+			t.Errorf("Wrong content: %d bytes, %v", len(content), err)
+		}
+	}
+
+	f, err := fs1.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f.Seek(ChunkSize-3, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f.Write([]byte("abcdef"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	copy(c[ChunkSize-3:], "abcdef")
+
+	f, err = fs1.Open(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	b := make([]byte, 10)
+	_, err = f.ReadAt(b, ChunkSize-5)
+	if err != nil || !bytes.Equal(c[ChunkSize-5:ChunkSize+5], b) {
+		t.Errorf("Wrong part: %q, %v", b, err)
+	}
+
+	f.Close()
+
+	// the changed chunks got their own blobs
+	count()
+	if blobs != 5 || refs != 6 {
+		t.Errorf("Wrong blobs after write: %d, refs: %d", blobs, refs)
+	}
+
+	err = CloneNamespace(db, tableName, "fork1", "fork3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	count()
+	if blobs != 5 || refs != 9 {
+		t.Errorf("Wrong blobs after clone: %d, refs: %d", blobs, refs)
+	}
+
+	err = fs2.Remove(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DropNamespace(db, tableName, "fork3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	n, err := CollectBlobs(db, tableName)
+	if err != nil || n != 2 {
+		t.Errorf("Wrong number of collected blobs: %d, %v", n, err)
+	}
+
+	// deduplicated content is read without the option too
+	fs3, err := NewWithOptions(db, tableName, Options{Namespace: "fork1"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err := readFile(fs3, path)
+	if !bytes.Equal(content, c) || err != nil {
+		t.Errorf("Wrong content without dedup: %d bytes, %v", len(content), err)
+	}
+
+	f, err = fs3.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = f.Truncate(5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	f.Close()
+
+	n, err = CollectBlobs(db, tableName)
+	if err != nil || n != 3 {
+		t.Errorf("Wrong number of collected blobs after truncate: %d, %v", n, err)
+	}
+
+	content, err = readFile(fs1, path)
+	if string(content) != "01234" || err != nil {
+		t.Errorf("Wrong content after truncate: %q, %v", content, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestSnapshotDedup(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{Namespace: "repo1", Dedup: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	for p, c := range map[string]string{"/file1.txt": "Hello", "/file2.txt": "World"} {
+		err = util.WriteFile(fs, p, []byte(c), 0666)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	blobs := 0
+	refs := 0
+
+	count := func() {
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(refs), 0) FROM %s_blobs", tableName)).Scan(&blobs, &refs)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the snapshot references the blobs of the chunks
+	err = mfs.Snapshot("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	count()
+	if blobs != 2 || refs != 4 {
+		t.Errorf("Wrong blobs after snapshot: %d, refs: %d", blobs, refs)
+	}
+
+	err = util.WriteFile(fs, "/file1.txt", []byte("Changed"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = mfs.Restore("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the restored chunks reference the blobs of the snapshot
+	count()
+	if blobs != 3 || refs != 4 {
+		t.Errorf("Wrong blobs after restore: %d, refs: %d", blobs, refs)
+	}
+
+	inline := 0
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_chunks WHERE data IS NOT NULL", tableName)).Scan(&inline)
+	if err != nil || inline != 0 {
+		t.Errorf("Restored chunks keep their data: %d, %v", inline, err)
+	}
+
+	err = mfs.DropSnapshot("first")
+	if err != nil {
+		t.Error(err)
+	}
+
+	count()
+	if blobs != 2 || refs != 2 {
+		t.Errorf("Wrong blobs after drop: %d, refs: %d", blobs, refs)
+	}
+
+	for p, c := range map[string]string{"/file1.txt": "Hello", "/file2.txt": "World"} {
+		content, err := readFile(fs, p)
+		if string(content) != c || err != nil {
+			t.Errorf("Wrong content of %s: %q, %v", p, content, err)
+		}
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestChangelog(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{Namespace: "repo1", Changelog: true, WatchInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	changes, seq, err := mfs.Changes("", 0, 100)
+	if err != nil || len(changes) != 0 || seq != 0 {
+		t.Errorf("Wrong changes of empty namespace: %+v, %d, %v", changes, seq, err)
+	}
+
+	err = util.WriteFile(fs, "/refs/heads/master", []byte("abc"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs.Rename("/refs/heads/master", "/refs/heads/main")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/objects/1.pack", []byte("pack"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fs.Remove("/refs/heads/main")
+	if err != nil {
+		t.Error(err)
+	}
+
+	all, head, err := mfs.Changes("", 0, 100)
+	if err != nil || len(all) == 0 || head != all[len(all)-1].Seq {
+		t.Fatalf("Wrong changes: %+v, %d, %v", all, head, err)
+	}
+
+	for i, c := range all {
+		if c.Seq != int64(i+1) {
+			t.Errorf("Wrong sequence of change %d: %+v", i, c)
+		}
+	}
+
+	for _, limit := range []int{0, -1} {
+		changes, seq, err = mfs.Changes("", 0, limit)
+		if err != ErrInvalidLimit || changes != nil || seq != 0 {
+			t.Errorf("Wrong changes with limit %d: %+v, %d, %v", limit, changes, seq, err)
+		}
+	}
+
+	changes, seq, err = mfs.Changes("refs/heads", 0, 100)
+	if err != nil || seq != head {
+		t.Errorf("Wrong changes under prefix: %d, %v", seq, err)
+	}
+
+	ops := []string{}
+	for _, c := range changes {
+		if c.Op == ChangeRename && c.From != "/refs/heads/master" {
+			t.Errorf("Wrong renamed path: %+v", c)
+		}
+
+		if strings.HasPrefix(c.Path, "/objects") {
+			t.Errorf("Change outside of prefix: %+v", c)
+		}
+
+		if len(ops) == 0 || ops[len(ops)-1] != c.Op {
+			ops = append(ops, c.Op)
+		}
+	}
+
+	if strings.Join(ops, ",") != "create,write,rename,remove" {
+		t.Errorf("Wrong operations under prefix: %v", ops)
+	}
+
+	// the cursor moves by the limit
+	changes, seq, err = mfs.Changes("", 0, 2)
+	if err != nil || len(changes) != 2 || seq != 2 {
+		t.Errorf("Wrong first page: %+v, %d, %v", changes, seq, err)
+	}
+
+	changes, seq, err = mfs.Changes("", seq, 100)
+	if err != nil || len(changes) != len(all)-2 || seq != head {
+		t.Errorf("Wrong second page: %+v, %d, %v", changes, seq, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w, err := mfs.Watch(ctx, "/refs", head)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/objects/2.pack", []byte("pack"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/refs/tags/v1", []byte("abc"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case c := <-w.Changes():
+		if c.Op != ChangeCreate || c.Path != "/refs/tags" {
+			t.Errorf("Wrong watched change: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No change was watched")
+	}
+
+	cancel()
+
+	for range w.Changes() {
+	}
+
+	if w.Err() != ErrCanceled {
+		t.Errorf("Wrong error of watcher: %v", w.Err())
+	}
+
+	// the watch is resumed from its cursor
+	resumed, _, err := mfs.Changes("/refs", w.Seq(), 100)
+	if err != nil || len(resumed) == 0 || resumed[0].Path != "/refs/tags/v1" {
+		t.Errorf("Wrong resumed changes: %+v, %v", resumed, err)
+	}
+
+	_, head, err = mfs.Changes("", 0, 100)
+	if err != nil {
+		t.Error(err)
+	}
+
+	n, err := TrimChanges(db, tableName, time.Hour)
+	if err != nil || n != 0 {
+		t.Errorf("Recent changes were trimmed: %d, %v", n, err)
+	}
+
+	n, err = TrimChanges(db, tableName, 0)
+	if err != nil || n != head {
+		t.Errorf("Wrong number of trimmed changes: %d, %v", n, err)
+	}
+
+	_, _, err = mfs.Changes("", 0, 100)
+	if err != ErrChangesTrimmed {
+		t.Errorf("Wrong error of trimmed changes: %v", err)
+	}
+
+	changes, seq, err = mfs.Changes("", head, 100)
+	if err != nil || len(changes) != 0 || seq != head {
+		t.Errorf("Wrong changes after trim: %+v, %d, %v", changes, seq, err)
+	}
+
+	// a rename of a dir above the prefix is read at any depth by the same
+	// statement
+	err = fs.Rename("/refs", "/refs1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s := mfs.storage.(*storage)
+	stmts := 0
+
+	for _, prefix := range []string{"/refs/tags", "/refs/tags/v1", "/refs1/tags/v1/a"} {
+		changes, seq, err = mfs.Changes(prefix, head, 100)
+		if err != nil || len(changes) != 1 || changes[0].Op != ChangeRename {
+			t.Errorf("Wrong changes under %s: %+v, %v", prefix, changes, err)
+		}
+
+		if stmts == 0 {
+			stmts = len(s.stmts.m)
+		}
+	}
+
+	if len(s.stmts.m) != stmts {
+		t.Errorf("Statements weren't reused: %d, %d", stmts, len(s.stmts.m))
+	}
+
+	head = seq
+
+	// without the option changes aren't recorded
+	fs1, err := NewWithOptions(db, tableName, Options{Namespace: "repo1"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs1, "/file.txt", []byte("abc"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, seq, err = mfs.Changes("", head, 100)
+	if err != nil || seq != head {
+		t.Errorf("Change was recorded without the option: %d, %v", seq, err)
+	}
+
+	mfs2, _ := Unwrap(NewWithStorage(NewMemoryStorage(), Options{}))
+
+	_, err = mfs2.Watch(context.Background(), "", 0)
+	if err != ErrChangelogUnsupported {
+		t.Errorf("Wrong error of memory storage: %v", err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestChangelogDefaultNamespace(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	fs, err := NewWithOptions(db, tableName, Options{Changelog: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	mfs, _ := Unwrap(fs)
+
+	changes, seq, err := mfs.Changes("", 0, 100)
+	if err != nil || len(changes) != 0 || seq != 0 {
+		t.Errorf("Wrong changes of empty namespace: %+v, %d, %v", changes, seq, err)
+	}
+
+	err = util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	changes, seq, err = mfs.Changes("", 0, 100)
+	if err != nil || len(changes) == 0 || seq != changes[len(changes)-1].Seq {
+		t.Errorf("Wrong changes: %+v, %d, %v", changes, seq, err)
+	}
+
+	namespaces, err := ListNamespaces(db, tableName)
+	if err != nil || len(namespaces) != 0 {
+		t.Errorf("Default namespace is listed: %v, %v", namespaces, err)
+	}
+
+	dropTable(connStr, tableName)
+
+	// the sequence is added to the namespaces of older versions
+	sdb := sqlx.NewDb(db, testDriver)
+	sdb.MustExec(fmt.Sprintf("CREATE TABLE %s_namespaces (name varchar(255) NOT NULL PRIMARY KEY)", tableName))
+	sdb.MustExec(sdb.Rebind(fmt.Sprintf("INSERT INTO %s_namespaces(name) VALUES(?)", tableName)), "repo1")
+
+	fs, err = NewWithOptions(db, tableName, Options{Namespace: "repo1", Changelog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, _ = Unwrap(fs)
+
+	err = util.WriteFile(fs, "/file1.txt", []byte("Hello"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	changes, _, err = mfs.Changes("", 0, 100)
+	if err != nil || len(changes) == 0 || changes[0].Seq != 1 {
+		t.Errorf("Wrong changes of migrated namespace: %+v, %v", changes, err)
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func TestObserver(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	policy := DefaultRetryPolicy
+	policy.MinBackoff = time.Millisecond
+	metrics := NewMetrics(nil)
+	events := []Event{}
+
+	fs, err := NewWithOptions(db, tableName, Options{
+		Retry:    policy,
+		Observer: Observers{metrics, ObserverFunc(func(e Event) { events = append(events, e) })},
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = util.WriteFile(fs, "/dir1/file1.txt", []byte("Hello world"), 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	content, err := readFile(fs, "/dir1/file1.txt")
+	if string(content) != "Hello world" || err != nil {
+		t.Errorf("Wrong content: %q, %v", content, err)
+	}
+
+	_, err = fs.Stat("/dir1/file2.txt")
+	if err != os.ErrNotExist {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	mfs, _ := Unwrap(fs)
+	calls := 0
+
+	err = mfs.Tx(func(fs billy.Filesystem) error {
+		calls++
+		if calls < 2 {
+			return driver.ErrBadConn
+		}
+
+		return fs.Remove("/dir1/file1.txt")
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	m := metrics.Snapshot()
+
+	if m["OpenFile"].Count != 2 || m["Close"].Count != 2 || m["Remove"].Count != 1 {
+		t.Errorf("Wrong counts of operations: %+v", m)
+	}
+
+	if m["Close"].Bytes != 11 || m["Read"].Bytes != 11 {
+		t.Errorf("Wrong bytes: written %d, read %d", m["Close"].Bytes, m["Read"].Bytes)
+	}
+
+	if m["Stat"].Errors != 1 || m["Stat"].Rows != 0 {
+		t.Errorf("Wrong metrics of Stat: %+v", m["Stat"])
+	}
+
+	if m["Tx"].Count != 1 || m["Tx"].Retries != 1 || m["Tx"].Errors != 0 {
+		t.Errorf("Wrong metrics of Tx: %+v", m["Tx"])
+	}
+
+	if m["Remove"].Rows == 0 {
+		t.Errorf("Rows of Remove weren't counted: %+v", m["Remove"])
+	}
+
+	latencies := int64(0)
+	for _, c := range m["OpenFile"].Latency.Counts {
+		latencies += c
+	}
+
+	if latencies != 2 {
+		t.Errorf("Wrong latency histogram: %+v", m["OpenFile"].Latency)
+	}
+
+	if len(events) == 0 || events[0].Op != "OpenFile" || events[0].Path != "/dir1/file1.txt" || events[0].Rows == 0 {
+		t.Errorf("Wrong first event: %+v", events)
+	}
+
+	metrics.Reset()
+
+	if len(metrics.Snapshot()) != 0 {
+		t.Error("Metrics weren't reset")
+	}
+
+	dropTable(connStr, tableName)
+}
+
+func readFile(fs billy.Filesystem, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func createNewFile(path string) (*File, error) {
+	db, err := createDB(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newStorage(db, tableName, Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.NewFile(path, 0666, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func connectToDB(connStr string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect(testDriver, connStr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return db, nil
+}
+
+func dropTable(connStr, tableName string) error {
+	db, err := sqlx.Connect(testDriver, connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-	return nil
+	return DropTables(db.DB, tableName)
 }
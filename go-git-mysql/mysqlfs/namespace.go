@@ -0,0 +1,365 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNamespaceExists - a namespace with the name already exists
+var ErrNamespaceExists = errors.New("namespace already exists")
+
+// ErrNamespaceNotFound - there is no namespace with the name
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// CreateNamespace creates an empty namespace in the table folderName. Open
+// the filesystem of the namespace with NewWithOptions and Options.Namespace.
+func CreateNamespace(db *sql.DB, folderName, namespace string) error {
+	s, err := newStorage(db, folderName, Options{Namespace: namespace})
+
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	err = s.ensureTables(namespaceTables...)
+
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(s *storage) error {
+		exists, err := s.namespaceExists(namespace)
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return ErrNamespaceExists
+		}
+
+		return s.registerNamespace(namespace)
+	})
+}
+
+// ListNamespaces returns the names of all the namespaces in the table
+// folderName, the default namespace isn't included
+func ListNamespaces(db *sql.DB, folderName string) ([]string, error) {
+	s, err := openExisting(db, folderName, Options{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+
+	res := []string{}
+
+	exists, err := s.hasTable("_namespaces")
+
+	if err != nil || !exists {
+		return res, err
+	}
+
+	// the default namespace has a row if its changes are recorded
+	err = s.sel(&res, fmt.Sprintf("SELECT name FROM %s WHERE name<>'' ORDER BY name", s.namespaceTableName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// CloneNamespace copies all the files of the namespace from into the new
+// namespace to. The copy is made in one transaction, deleted files aren't
+// copied.
+func CloneNamespace(db *sql.DB, folderName, from, to string) error {
+	return CloneNamespaceWithOptions(db, folderName, from, to, Options{})
+}
+
+// CloneNamespaceWithOptions is CloneNamespace with the options of the
+// filesystem, Options.Namespace is ignored. Encrypted content is bound to
+// its namespace, so it can be cloned only with Options.KeyProvider.
+func CloneNamespaceWithOptions(db *sql.DB, folderName, from, to string, options Options) error {
+	options.Namespace = from
+	s, err := newStorage(db, folderName, options)
+
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	err = s.ensureTables(namespaceTables...)
+
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(s *storage) error {
+		exists, err := s.namespaceExists(from)
+
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return ErrNamespaceNotFound
+		}
+
+		exists, err = s.namespaceExists(to)
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return ErrNamespaceExists
+		}
+
+		err = s.registerNamespace(to)
+
+		if err != nil {
+			return err
+		}
+
+		// parents have shorter paths, so they are copied before children
+		// and their new ids are known
+		files := []FileDB{}
+		err = s.sel(&files, fmt.Sprintf("SELECT %s FROM %s WHERE namespace=? AND deleted_at IS NULL ORDER BY %s", fileColumns, s.fileTableName, s.dialect.CharLength("path")), from)
+
+		if err != nil {
+			return err
+		}
+
+		// the clone gets the data keys, encrypted content is sealed again
+		// with them
+		keys := []dataKeyDB{}
+		hasKeys, err := s.hasTable("_keys")
+
+		if err == nil && hasKeys {
+			err = s.sel(&keys, fmt.Sprintf("SELECT version, kekID, dataKey FROM %s WHERE namespace=?", s.keyTableName), from)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			_, err = s.exec(fmt.Sprintf("INSERT INTO %s(namespace, version, kekID, dataKey) VALUES(?,?,?,?)", s.keyTableName),
+				to, k.Version, k.KekID, k.DataKey)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		ids := make(map[int64]int64, len(files))
+
+		for _, f := range files {
+			parentID := sql.NullInt64{}
+			if f.ParentID.Valid {
+				id, ok := ids[f.ParentID.Int64]
+
+				if !ok {
+					return fmt.Errorf("mysqlfs: parent of %q isn't in namespace %q, see Check", f.Path, from)
+				}
+
+				parentID = sql.NullInt64{Int64: id, Valid: true}
+			}
+
+			id, err := s.insert(
+				fmt.Sprintf("INSERT INTO %s(namespace,parentID,name,path,flag,mode,size,mtime,ctime,uid,gid) VALUES(?,?,?,?,?,?,?,?,?,?,?)", s.fileTableName),
+				to, parentID, f.Name, f.Path, f.Flag, f.Mode, f.Size, f.MTime, f.CTime, f.UID, f.GID)
+
+			if err != nil {
+				return err
+			}
+
+			ids[f.ID] = id
+
+			err = s.copyChunks(f.ID, id, to)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DropNamespace removes the namespace with all its files, snapshots and
+// locks. Dropping the default namespace removes its files.
+func DropNamespace(db *sql.DB, folderName, namespace string) error {
+	s, err := newStorage(db, folderName, Options{Namespace: namespace})
+
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	return s.withTx(func(s *storage) error {
+		exists, err := s.namespaceExists(namespace)
+
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return ErrNamespaceNotFound
+		}
+
+		files := fmt.Sprintf("fileID IN (SELECT id FROM %s WHERE namespace=?)", s.fileTableName)
+
+		err = s.releaseBlobs(files, namespace)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE %s", s.chunkTableName, files), namespace)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE namespace=?", s.fileTableName), namespace)
+
+		if err != nil {
+			return err
+		}
+
+		err = s.dropSnapshots()
+
+		if err != nil {
+			return err
+		}
+
+		// the tables of the features which were never used don't exist
+		for _, t := range []struct{ suffix, table, column string }{
+			{"_locks", s.lockTableName, "namespace"},
+			{"_keys", s.keyTableName, "namespace"},
+			{"_changes", s.changeTableName, "namespace"},
+			{"_namespaces", s.namespaceTableName, "name"},
+		} {
+			exists, err := s.hasTable(t.suffix)
+
+			if err == nil && exists {
+				_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE %s=?", t.table, t.column), namespace)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// dropSnapshots removes all the snapshots of the namespace and their
+// references of the blobs
+func (s *storage) dropSnapshots() error {
+	exists, err := s.hasTable("_snapshots")
+
+	if err != nil || !exists {
+		return err
+	}
+
+	ids := []int64{}
+
+	err = s.sel(&ids, fmt.Sprintf("SELECT id FROM %s WHERE namespace=?", s.snapshotTableName), s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = s.dropSnapshot(id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyChunks copies the content of the file from to the file to of the
+// namespace, one chunk at a time
+func (s *storage) copyChunks(from, to int64, namespace string) error {
+	indexes := []int64{}
+
+	err := s.sel(&indexes, fmt.Sprintf("SELECT chunkIndex FROM %s WHERE fileID=?", s.chunkTableName), from)
+
+	if err != nil {
+		return err
+	}
+
+	for _, i := range indexes {
+		c := storedChunkDB{}
+
+		err = s.get(&c, fmt.Sprintf("SELECT data, hash FROM %s WHERE fileID=? AND chunkIndex=?", s.chunkTableName), from, i)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := s.blobData(&c)
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(data) > 0 && data[0] == encryptedChunk:
+			data, err = s.reseal(from, to, i, namespace, data)
+
+			if err == nil {
+				_, err = s.exec(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, data) VALUES(?,?,?)", s.chunkTableName), to, i, data)
+			}
+		case c.Data == nil && c.Hash.Valid:
+			// the copy shares the blob of the chunk
+			err = s.copyBlobRef(to, i, c.Hash.String)
+		default:
+			_, err = s.exec(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, data) VALUES(?,?,?)", s.chunkTableName), to, i, c.Data)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerNamespace adds the namespace to the list of namespaces if it isn't
+// there yet
+func (s *storage) registerNamespace(namespace string) error {
+	_, err := s.exec(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(name) VALUES(?)", s.namespaceTableName)), namespace)
+
+	return err
+}
+
+// namespaceExists reports if the namespace was created, the default
+// namespace always exists
+func (s *storage) namespaceExists(namespace string) (bool, error) {
+	if namespace == "" {
+		return true, nil
+	}
+
+	count := 0
+
+	err := s.get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE name=?", s.namespaceTableName), namespace)
+
+	if err != nil {
+		return false, err
+	}
+
+	return count != 0, nil
+}
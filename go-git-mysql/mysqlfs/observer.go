@@ -0,0 +1,265 @@
+package mysqlfs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event - an operation of the filesystem or of a file, which has finished
+type Event struct {
+	// Op - name of the method, e.g. "OpenFile", "Stat" or "Write"
+	Op   string
+	Path string
+	// Rows - number of rows read or changed by the queries of the operation
+	Rows int64
+	// Bytes - number of content bytes read from or written to db
+	Bytes   int64
+	Latency time.Duration
+	// Retries - number of transactions replayed by the retry policy
+	Retries int
+	Err     error
+}
+
+// Observer receives the events of the operations of mysqlfs. Events are
+// reported synchronously from the goroutine running the operation.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc - function used as Observer
+type ObserverFunc func(e Event)
+
+// Observe calls f
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// Observers - Observer passing each event to all of its observers
+type Observers []Observer
+
+// Observe passes the event to all the observers
+func (o Observers) Observe(e Event) {
+	for _, observer := range o {
+		observer.Observe(e)
+	}
+}
+
+// DefaultLatencyBuckets - upper bounds of the latency histogram buckets of
+// Metrics
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Histogram - counts of values by buckets. Counts[i] is the number of
+// values not greater than Bounds[i], the last count is the number of values
+// greater than all the bounds.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) add(d time.Duration) {
+	h.Counts[sort.Search(len(h.Bounds), func(i int) bool { return d <= h.Bounds[i] })]++
+	h.Sum += d
+}
+
+// OpMetrics - aggregated events of one operation
+type OpMetrics struct {
+	Count   int64
+	Errors  int64
+	Rows    int64
+	Bytes   int64
+	Retries int64
+	Latency Histogram
+}
+
+// Metrics - Observer aggregating the events by operation in memory
+type Metrics struct {
+	mu      sync.Mutex
+	buckets []time.Duration
+	ops     map[string]*OpMetrics
+}
+
+// NewMetrics creates Metrics with the latency histograms of the buckets,
+// nil means DefaultLatencyBuckets
+func NewMetrics(buckets []time.Duration) *Metrics {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+
+	return &Metrics{buckets: buckets, ops: map[string]*OpMetrics{}}
+}
+
+// Observe adds the event to the metrics of its operation
+func (m *Metrics) Observe(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, ok := m.ops[e.Op]
+
+	if !ok {
+		op = &OpMetrics{Latency: newHistogram(m.buckets)}
+		m.ops[e.Op] = op
+	}
+
+	op.Count++
+	op.Rows += e.Rows
+	op.Bytes += e.Bytes
+	op.Retries += int64(e.Retries)
+	op.Latency.add(e.Latency)
+
+	if e.Err != nil {
+		op.Errors++
+	}
+}
+
+// Snapshot returns a copy of the metrics by operation
+func (m *Metrics) Snapshot() map[string]OpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make(map[string]OpMetrics, len(m.ops))
+
+	for name, op := range m.ops {
+		c := *op
+		c.Latency.Counts = append([]int64{}, op.Latency.Counts...)
+		res[name] = c
+	}
+
+	return res
+}
+
+// Reset removes all the metrics
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ops = map[string]*OpMetrics{}
+}
+
+// opStats - counters of one operation, the storage finds them in the
+// context of its queries
+type opStats struct {
+	rows    int64
+	bytes   int64
+	retries int64
+}
+
+type opStatsKey struct{}
+
+func statsFromContext(ctx context.Context) *opStats {
+	st, _ := ctx.Value(opStatsKey{}).(*opStats)
+
+	return st
+}
+
+func (st *opStats) addRows(n int64) {
+	if st != nil {
+		atomic.AddInt64(&st.rows, n)
+	}
+}
+
+func (st *opStats) addBytes(n int64) {
+	if st != nil {
+		atomic.AddInt64(&st.bytes, n)
+	}
+}
+
+func (st *opStats) addRetry() {
+	if st != nil {
+		atomic.AddInt64(&st.retries, 1)
+	}
+}
+
+// observation - an operation which is being observed
+type observation struct {
+	observer Observer
+	op       string
+	path     string
+	start    time.Time
+	stats    *opStats
+}
+
+// startObservation returns the observation of the operation and ctx with
+// its counters
+func startObservation(ctx context.Context, observer Observer, op, path string) (*observation, context.Context) {
+	o := &observation{observer: observer, op: op, path: path, start: time.Now(), stats: &opStats{}}
+
+	return o, context.WithValue(ctx, opStatsKey{}, o.stats)
+}
+
+// done reports the event of the operation
+func (o *observation) done(err error) {
+	o.observer.Observe(Event{
+		Op:      o.op,
+		Path:    o.path,
+		Rows:    atomic.LoadInt64(&o.stats.rows),
+		Bytes:   atomic.LoadInt64(&o.stats.bytes),
+		Latency: time.Since(o.start),
+		Retries: int(atomic.LoadInt64(&o.stats.retries)),
+		Err:     err,
+	})
+}
+
+// stats returns the counters of the operation running the queries of s
+func (s *storage) stats() *opStats {
+	return statsFromContext(s.ctx)
+}
+
+// observe starts the observation of the operation of the filesystem. It
+// returns the filesystem running the queries of the operation and the
+// function reporting its result. An operation run by another observed one is
+// part of that one and isn't reported.
+func (fs *Mysqlfs) observe(op, path string) (*Mysqlfs, func(err error)) {
+	if fs.options.Observer == nil || fs.observed {
+		return fs, func(error) {}
+	}
+
+	o, ctx := startObservation(contextOrBackground(fs.ctx), fs.options.Observer, op, path)
+
+	return &Mysqlfs{storage: fs.storage.WithContext(ctx), options: fs.options, ctx: fs.ctx, observed: true}, o.done
+}
+
+// observe starts the observation of the operation of the file, its queries
+// are counted until the returned function reports the result
+func (f *File) observe(op string) func(err error) {
+	if f.observer == nil || f.observing {
+		return func(error) {}
+	}
+
+	o, ctx := startObservation(contextOrBackground(f.ctx), f.observer, op, f.Path)
+	s := f.storage
+	f.storage = s.WithContext(ctx)
+	f.observing = true
+
+	return func(err error) {
+		f.storage = s
+		f.observing = false
+		o.done(err)
+	}
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+
+	return ctx
+}
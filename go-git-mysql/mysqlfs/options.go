@@ -0,0 +1,94 @@
+package mysqlfs
+
+import "time"
+
+// DefaultFlushThreshold - number of buffered bytes after which a file is
+// flushed to db before Close or Sync
+const DefaultFlushThreshold = 4 * 1024 * 1024
+
+// DefaultLockExpiry - time after which the lock of a crashed holder is
+// released
+const DefaultLockExpiry = 30 * time.Second
+
+// Options - settings of a mysqlfs filesystem
+type Options struct {
+	// FlushThreshold - writes to a file are buffered in memory and saved to
+	// db on Close and Sync or when the number of buffered bytes reaches the
+	// threshold. Zero means DefaultFlushThreshold, a negative value disables
+	// flushing by threshold.
+	FlushThreshold int
+	// Namespace - files of the filesystem are kept in the shared table
+	// under this key, so many filesystems can use one table. Empty is the
+	// default namespace.
+	Namespace string
+	// Dialect - SQL flavour of the db. Nil means the dialect is chosen by
+	// the driver of the db, MySQL for unknown drivers.
+	Dialect Dialect
+	// LockExpiry - a lock taken by File.Lock is renewed while it is held and
+	// expires after this time if the holder crashed. Zero means
+	// DefaultLockExpiry.
+	LockExpiry time.Duration
+	// Compression - compressor of the saved file content, nil means the
+	// content isn't compressed. Content saved with any registered
+	// compressor can be read regardless of the option.
+	Compression Compressor
+	// KeyProvider - if it is set, file content is encrypted with AES-GCM
+	// by data keys of the namespace, which are wrapped by the provider
+	KeyProvider KeyProvider
+	// CacheSize - maximum number of file rows cached by path. A cached row
+	// is checked against the version of the row in db before it's used, so
+	// changes made by other processes are seen. Zero disables the cache.
+	CacheSize int
+	// QueryTimeout - a query running longer fails with ErrQueryTimeout,
+	// zero means no timeout
+	QueryTimeout time.Duration
+	// Retry - policy of retrying transactions failed with transient
+	// errors, the zero value disables retries. See DefaultRetryPolicy.
+	Retry RetryPolicy
+	// Observer - receives an event for every operation of the filesystem
+	// and of its files, nil disables the events
+	Observer Observer
+	// SoftDelete - removed files are moved to the trash instead of being
+	// deleted. They can be listed by Mysqlfs.ListDeleted, restored by
+	// Mysqlfs.Undelete and are removed for good by PurgeDeleted. The memory
+	// storage deletes files right away.
+	SoftDelete bool
+	// Dedup - content is saved in blobs by the SHA-256 hash of the saved
+	// chunks, so identical chunks of all the files and namespaces of the
+	// table are stored once. Encrypted chunks differ by their nonces and
+	// aren't shared. The option can be turned on for an existing table,
+	// blobs left without references are removed by CollectBlobs. The memory
+	// storage ignores it.
+	Dedup bool
+	// Changelog - creates, writes, renames and removes of files are
+	// recorded in the changelog of the namespace, which is read by
+	// Mysqlfs.Changes and Mysqlfs.Watch. The memory storage ignores it.
+	Changelog bool
+	// WatchInterval - pause between the polls of Mysqlfs.Watch, zero means
+	// DefaultWatchInterval
+	WatchInterval time.Duration
+}
+
+func (o Options) flushThreshold() int {
+	if o.FlushThreshold == 0 {
+		return DefaultFlushThreshold
+	}
+
+	return o.FlushThreshold
+}
+
+func (o Options) watchInterval() time.Duration {
+	if o.WatchInterval <= 0 {
+		return DefaultWatchInterval
+	}
+
+	return o.WatchInterval
+}
+
+func (o Options) lockExpiry() time.Duration {
+	if o.LockExpiry <= 0 {
+		return DefaultLockExpiry
+	}
+
+	return o.LockExpiry
+}
@@ -0,0 +1,108 @@
+package mysqlfs
+
+import (
+	"database/sql/driver"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// RetryPolicy - how transactions failed with transient errors are retried.
+// A retry replays the whole transaction, so the function passed to
+// Mysqlfs.Tx may be called several times.
+type RetryPolicy struct {
+	// MaxRetries - number of retries after the first attempt, zero
+	// disables retries
+	MaxRetries int
+	// MinBackoff - pause before the first retry, it doubles with each
+	// retry up to MaxBackoff. The pause is randomized to spread the retries
+	// of concurrent transactions.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retryable - classifies errors as transient, nil means IsRetryable
+	Retryable func(err error) bool
+	// OnRetry is called before each retry with its number, starting at 1,
+	// and the error of the failed attempt
+	OnRetry func(retry int, err error)
+}
+
+// DefaultRetryPolicy - retry policy suitable for MySQL
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MinBackoff: 10 * time.Millisecond,
+	MaxBackoff: time.Second,
+}
+
+// MySQL error numbers of transient errors
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+// IsRetryable reports whether err is transient: a deadlock, a lock wait
+// timeout or a dropped connection
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == errDeadlock || e.Number == errLockWaitTimeout
+	case net.Error:
+		return true
+	}
+
+	return err == driver.ErrBadConn || err == mysql.ErrInvalidConn
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+
+	return IsRetryable(err)
+}
+
+// backoff returns the pause before the retry
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry runs fn until it succeeds, fails with an error which isn't
+// transient or the retries run out
+func (s *storage) retry(fn func() error) error {
+	for retry := 1; ; retry++ {
+		err := fn()
+
+		if err == nil || retry > s.retryPolicy.MaxRetries || !s.retryPolicy.retryable(err) {
+			return err
+		}
+
+		s.stats().addRetry()
+
+		if s.retryPolicy.OnRetry != nil {
+			s.retryPolicy.OnRetry(retry, err)
+		}
+
+		t := time.NewTimer(s.retryPolicy.backoff(retry))
+
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			t.Stop()
+			return ErrCanceled
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrTableNotFound - the table of the filesystem doesn't exist
+var ErrTableNotFound = errors.New("mysqlfs: table not found")
+
+// ErrTableOutdated - the table was created by an older version, opening the
+// filesystem with New upgrades it
+var ErrTableOutdated = errors.New("mysqlfs: table was created by an older version")
+
+// tableDef - a table of the filesystem, its name is the name of the files
+// table followed by the suffix. Columns added to the definition after the
+// table was released are added to the existing tables by addColumns.
+type tableDef struct {
+	suffix  string
+	columns []string
+	indexes [][]string
+}
+
+// The files and chunks tables are created when the filesystem is opened.
+// The tables of a feature are created when its option is turned on or by
+// the first use of the feature.
+var (
+	coreTables      = []string{"", "_chunks"}
+	namespaceTables = []string{"_namespaces"}
+	lockTables      = []string{"_locks"}
+	keyTables       = []string{"_keys"}
+	blobTables      = []string{"_blobs"}
+	snapshotTables  = []string{"_snapshots", "_snapshot_files", "_snapshot_chunks", "_blobs"}
+	changeTables    = []string{"_namespaces", "_changes"}
+)
+
+// tableSet - suffixes of the tables created by the storage and its copies
+type tableSet struct {
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// tables returns the definitions of all the tables of the filesystem
+func (s *storage) tables() []tableDef {
+	return []tableDef{
+		{
+			columns: []string{
+				s.dialect.IDColumn(),
+				"namespace varchar(255) NOT NULL DEFAULT ''",
+				"parentID BIGINT",
+				"name varchar(255) NOT NULL",
+				"path varchar(255) NOT NULL",
+				"flag INT",
+				"mode BIGINT",
+				"size BIGINT NOT NULL DEFAULT 0",
+				"mtime BIGINT NOT NULL DEFAULT 0",
+				"ctime BIGINT NOT NULL DEFAULT 0",
+				"uid INT NOT NULL DEFAULT 0",
+				"gid INT NOT NULL DEFAULT 0",
+				"version BIGINT NOT NULL DEFAULT 0",
+				"content_version BIGINT NOT NULL DEFAULT 0",
+				"deleted_at BIGINT",
+				"deleted_path varchar(255)",
+				"UNIQUE (namespace, path)",
+			},
+			indexes: [][]string{{"namespace", "parentID"}},
+		},
+		{
+			suffix: "_chunks",
+			columns: []string{
+				"fileID BIGINT NOT NULL",
+				"chunkIndex BIGINT NOT NULL",
+				"data " + s.dialect.BlobType(),
+				// hash - if data is NULL, the chunk references the blob with
+				// the hash, which holds its data. Otherwise the hash of data
+				// saved as a blob by a snapshot, NULL after the chunk changes.
+				"hash varchar(64)",
+				"PRIMARY KEY (fileID, chunkIndex)",
+			},
+		},
+		{
+			suffix: "_namespaces",
+			columns: []string{
+				"name varchar(255) NOT NULL PRIMARY KEY",
+				// seq - number of the last change of the namespace
+				"seq BIGINT NOT NULL DEFAULT 0",
+			},
+		},
+		{
+			suffix: "_locks",
+			columns: []string{
+				"namespace varchar(255) NOT NULL",
+				"path varchar(255) NOT NULL",
+				"owner varchar(64) NOT NULL",
+				"expires BIGINT NOT NULL",
+				"PRIMARY KEY (namespace, path)",
+			},
+		},
+		{
+			suffix: "_keys",
+			columns: []string{
+				"namespace varchar(255) NOT NULL",
+				"version BIGINT NOT NULL",
+				"kekID varchar(255) NOT NULL",
+				"dataKey " + s.dialect.BlobType() + " NOT NULL",
+				"PRIMARY KEY (namespace, version)",
+			},
+		},
+		{
+			suffix: "_snapshots",
+			columns: []string{
+				s.dialect.IDColumn(),
+				"namespace varchar(255) NOT NULL",
+				"name varchar(255) NOT NULL",
+				"created BIGINT NOT NULL",
+				"UNIQUE (namespace, name)",
+			},
+		},
+		{
+			suffix: "_snapshot_files",
+			columns: []string{
+				"snapshotID BIGINT NOT NULL",
+				"id BIGINT NOT NULL",
+				"parentID BIGINT",
+				"name varchar(255) NOT NULL",
+				"path varchar(255) NOT NULL",
+				"flag INT",
+				"mode BIGINT",
+				"size BIGINT NOT NULL DEFAULT 0",
+				"mtime BIGINT NOT NULL DEFAULT 0",
+				"ctime BIGINT NOT NULL DEFAULT 0",
+				"uid INT NOT NULL DEFAULT 0",
+				"gid INT NOT NULL DEFAULT 0",
+				"PRIMARY KEY (snapshotID, id)",
+			},
+		},
+		{
+			suffix: "_snapshot_chunks",
+			columns: []string{
+				"snapshotID BIGINT NOT NULL",
+				"fileID BIGINT NOT NULL",
+				"chunkIndex BIGINT NOT NULL",
+				"hash varchar(64) NOT NULL",
+				"PRIMARY KEY (snapshotID, fileID, chunkIndex)",
+			},
+			indexes: [][]string{{"hash"}},
+		},
+		{
+			suffix: "_blobs",
+			columns: []string{
+				"hash varchar(64) NOT NULL PRIMARY KEY",
+				"data " + s.dialect.BlobType(),
+				"refs BIGINT NOT NULL DEFAULT 0",
+			},
+			// CollectBlobs looks for the blobs without references
+			indexes: [][]string{{"refs"}},
+		},
+		{
+			suffix: "_changes",
+			columns: []string{
+				"namespace varchar(255) NOT NULL",
+				"seq BIGINT NOT NULL",
+				"op varchar(16) NOT NULL",
+				"path varchar(255) NOT NULL",
+				"fromPath varchar(255) NOT NULL DEFAULT ''",
+				"created BIGINT NOT NULL",
+				"PRIMARY KEY (namespace, seq)",
+			},
+			indexes: [][]string{{"created"}},
+		},
+	}
+}
+
+// ensureTables creates the tables with the suffixes if they don't exist
+// yet, each table is created once by all the copies of the storage
+func (s *storage) ensureTables(suffixes ...string) error {
+	s.tableSet.mu.Lock()
+	defer s.tableSet.mu.Unlock()
+
+	var tables []tableDef
+	for _, t := range s.tables() {
+		for _, suffix := range suffixes {
+			if t.suffix == suffix && !s.tableSet.created[suffix] {
+				tables = append(tables, t)
+				break
+			}
+		}
+	}
+
+	err := s.createTables(tables)
+
+	if err != nil {
+		return err
+	}
+
+	// tables created in a transaction are dropped by its rollback, see
+	// execDDL
+	if s.tx == nil || s.dialect == MySQL {
+		for _, t := range tables {
+			s.tableSet.created[t.suffix] = true
+		}
+	}
+
+	return nil
+}
+
+// hasTable reports if the table with the suffix exists
+func (s *storage) hasTable(suffix string) (bool, error) {
+	s.tableSet.mu.Lock()
+	created := s.tableSet.created[suffix]
+	s.tableSet.mu.Unlock()
+
+	if created {
+		return true, nil
+	}
+
+	columns, err := s.tableColumns(s.folderName + suffix)
+
+	return len(columns) != 0, err
+}
+
+// execDDL runs a statement which creates or changes a table. MySQL commits
+// the running transaction before DDL, so there the statement runs outside
+// of it. In the other dbs it runs in the transaction, which would block it
+// otherwise.
+func (s *storage) execDDL(stmt string) error {
+	var err error
+	if s.tx != nil && s.dialect != MySQL {
+		_, err = s.tx.ExecContext(s.ctx, stmt)
+	} else {
+		_, err = s.db.ExecContext(s.ctx, stmt)
+	}
+
+	return err
+}
+
+// queryer returns the transaction of the storage or its db
+func (s *storage) queryer() sqlx.QueryerContext {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.db
+}
+
+// createTables creates the tables which don't exist yet and adds the
+// missing columns to the existing ones
+func (s *storage) createTables(tables []tableDef) error {
+	for _, t := range tables {
+		// the statements creating the tables run once, they aren't
+		// prepared. The first one creates the table, the columns are added
+		// before the indexes which can use them.
+		stmts := s.dialect.CreateTable(s.folderName+t.suffix, t.columns, t.indexes)
+
+		err := s.execDDL(stmts[0])
+
+		if err != nil {
+			return err
+		}
+
+		err = s.addColumns(t)
+
+		if err == nil {
+			err = s.addIndexes(t)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range stmts[1:] {
+			err = s.execDDL(stmt)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the names of the columns of the table in lower
+// case, the set is empty if the table doesn't exist
+func (s *storage) tableColumns(table string) (map[string]bool, error) {
+	if s.dialect.FoldsNames() {
+		table = strings.ToLower(table)
+	}
+
+	names := []string{}
+
+	err := sqlx.SelectContext(s.ctx, s.queryer(), &names, s.db.Rebind(s.dialect.Columns()), table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]bool{}
+	for _, n := range names {
+		res[strings.ToLower(n)] = true
+	}
+
+	return res, nil
+}
+
+// columnName returns the name of the column defined by def in lower case,
+// an empty string if def defines a key
+func columnName(def string) string {
+	name := strings.ToLower(strings.Fields(def)[0])
+
+	if name == "unique" || name == "primary" {
+		return ""
+	}
+
+	return name
+}
+
+// checkTables returns ErrTableNotFound if a table with the suffixes doesn't
+// exist and ErrTableOutdated if it lacks columns added by newer versions.
+// The tables aren't changed.
+func (s *storage) checkTables(suffixes ...string) error {
+	for _, t := range s.tables() {
+		for _, suffix := range suffixes {
+			if t.suffix != suffix {
+				continue
+			}
+
+			columns, err := s.tableColumns(s.folderName + t.suffix)
+
+			if err != nil {
+				return err
+			}
+
+			if len(columns) == 0 {
+				return ErrTableNotFound
+			}
+
+			// the content column is dropped by migrateContent
+			if columns["content"] && t.suffix == "" {
+				return ErrTableOutdated
+			}
+
+			for _, c := range t.columns {
+				if name := columnName(c); name != "" && !columns[name] {
+					return ErrTableOutdated
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// addColumns adds the columns of the definition which the table created by
+// an older version doesn't have
+func (s *storage) addColumns(t tableDef) error {
+	table := s.folderName + t.suffix
+
+	columns, err := s.tableColumns(table)
+
+	if err != nil {
+		return err
+	}
+
+	added := map[string]bool{}
+
+	for _, c := range t.columns {
+		name := columnName(c)
+
+		if name == "" || columns[name] {
+			continue
+		}
+
+		err = s.execDDL(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", s.dialect.Quote(table), c))
+
+		if err != nil {
+			// the column could be added by another process meanwhile
+			columns, cerr := s.tableColumns(table)
+
+			if cerr != nil || !columns[name] {
+				return err
+			}
+
+			continue
+		}
+
+		added[name] = true
+	}
+
+	// paths were unique in the whole files table before namespaces, such
+	// tables were created only on MySQL
+	if t.suffix == "" && added["namespace"] && s.dialect == MySQL {
+		return s.migrateUniquePath()
+	}
+
+	return nil
+}
+
+// addIndexes adds the indexes of the definition which the table created by
+// an older version doesn't have. Only MySQL needs it, the other dbs create
+// the missing indexes by CREATE INDEX IF NOT EXISTS.
+func (s *storage) addIndexes(t tableDef) error {
+	if s.dialect != MySQL || len(t.indexes) == 0 {
+		return nil
+	}
+
+	table := s.folderName + t.suffix
+	existing := []string{}
+
+	err := s.db.SelectContext(s.ctx, &existing, "SELECT LOWER(GROUP_CONCAT(column_name ORDER BY seq_in_index)) FROM information_schema.statistics "+
+		"WHERE table_schema=DATABASE() AND table_name=? GROUP BY index_name", table)
+
+	if err != nil {
+		return err
+	}
+
+	has := map[string]bool{}
+	for _, idx := range existing {
+		has[idx] = true
+	}
+
+	for _, idx := range t.indexes {
+		if has[strings.ToLower(strings.Join(idx, ","))] {
+			continue
+		}
+
+		err = s.execDDL(fmt.Sprintf("ALTER TABLE %s ADD INDEX (%s)", s.dialect.Quote(table), strings.Join(idx, ", ")))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateUniquePath replaces the unique index of paths of the files table
+// by the unique index of paths in namespaces
+func (s *storage) migrateUniquePath() error {
+	name := ""
+
+	err := s.db.GetContext(s.ctx, &name, "SELECT index_name FROM information_schema.statistics "+
+		"WHERE table_schema=DATABASE() AND table_name=? AND non_unique=0 AND index_name<>'PRIMARY' "+
+		"GROUP BY index_name HAVING COUNT(*)=1 AND MAX(column_name)='path'", s.folderName)
+
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	drop := ""
+	if err == nil {
+		drop = fmt.Sprintf("DROP INDEX %s, ", s.dialect.Quote(name))
+	}
+
+	return s.execDDL(fmt.Sprintf("ALTER TABLE %s %sADD UNIQUE (namespace, path), ADD INDEX (namespace, parentID)", s.fileTableName, drop))
+}
+
+// migrateContent moves the content kept in the files table by the first
+// versions into chunks and drops the content column
+func (s *storage) migrateContent() error {
+	columns, err := s.tableColumns(s.folderName)
+
+	if err != nil || !columns["content"] {
+		return err
+	}
+
+	// all the rows are in the default namespace, content was moved to
+	// chunks before namespaces were added
+	ms := *s
+	ms.namespace = ""
+	ms.changelog = false
+
+	ids := []int64{}
+
+	err = s.db.SelectContext(s.ctx, &ids, fmt.Sprintf("SELECT id FROM %s WHERE content IS NOT NULL", s.fileTableName))
+
+	if err != nil {
+		return err
+	}
+
+	// each file is moved in its own transaction, a file moved by another
+	// process meanwhile has no content left
+	for _, id := range ids {
+		err = ms.withTx(func(s *storage) error {
+			var content []byte
+
+			err := s.get(&content, fmt.Sprintf("SELECT content FROM %s WHERE id=? AND content IS NOT NULL%s", s.fileTableName, s.dialect.ForUpdate()), id)
+
+			if err == sql.ErrNoRows {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			err = s.UpdateFileContent(id, content)
+
+			if err != nil {
+				return err
+			}
+
+			_, err = s.exec(fmt.Sprintf("UPDATE %s SET content=NULL WHERE id=?", s.fileTableName), id)
+
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.execDDL(fmt.Sprintf("ALTER TABLE %s DROP COLUMN content", s.fileTableName))
+
+	if err != nil {
+		// the column could be dropped by another process meanwhile
+		columns, cerr := s.tableColumns(s.folderName)
+
+		if cerr == nil && !columns["content"] {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// DropTables removes the table folderName of a filesystem with all the
+// tables of its features which exist
+func DropTables(db *sql.DB, folderName string) error {
+	s, err := openStorage(db, folderName, Options{})
+
+	if err != nil {
+		return err
+	}
+
+	for _, t := range s.tables() {
+		_, err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", s.dialect.Quote(folderName+t.suffix)))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
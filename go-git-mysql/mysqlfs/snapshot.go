@@ -0,0 +1,387 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrSnapshotExists - the namespace already has a snapshot with the name
+var ErrSnapshotExists = errors.New("mysqlfs: snapshot already exists")
+
+// ErrSnapshotNotFound - the namespace has no snapshot with the name
+var ErrSnapshotNotFound = errors.New("mysqlfs: snapshot not found")
+
+// ErrSnapshotsUnsupported - the storage of the filesystem can't take
+// snapshots
+var ErrSnapshotsUnsupported = errors.New("mysqlfs: snapshots aren't supported by the storage")
+
+// SnapshotInfo - a snapshot of the files of a namespace
+type SnapshotInfo struct {
+	Name string `db:"name"`
+	// Created - unix time of the snapshot in nanoseconds
+	Created int64 `db:"created"`
+}
+
+// Snapshot saves the current files of the namespace as the snapshot with
+// the name. The snapshot keeps the rows of the files, the content is saved
+// as blobs by hash and shared by all the snapshots, so only the chunks
+// changed since the previous snapshot are copied.
+func (fs *Mysqlfs) Snapshot(name string) error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return ErrSnapshotsUnsupported
+	}
+
+	err := s.ensureTables(snapshotTables...)
+
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(s *storage) error {
+		_, err := s.snapshotID(name)
+
+		if err == nil {
+			return ErrSnapshotExists
+		}
+
+		if err != ErrSnapshotNotFound {
+			return err
+		}
+
+		err = s.saveBlobs()
+
+		if err != nil {
+			return err
+		}
+
+		id, err := s.insert(fmt.Sprintf("INSERT INTO %s(namespace, name, created) VALUES(?,?,?)", s.snapshotTableName),
+			s.namespace, name, time.Now().UnixNano())
+
+		if err != nil {
+			return err
+		}
+
+		// the id of the snapshot is selected from its row, a bind variable
+		// in the select list has no type in PostgreSQL
+		_, err = s.exec(fmt.Sprintf("INSERT INTO %s(snapshotID, id, parentID, name, path, flag, mode, size, mtime, ctime, uid, gid) "+
+			"SELECT sn.id, f.id, f.parentID, f.name, f.path, f.flag, f.mode, f.size, f.mtime, f.ctime, f.uid, f.gid FROM %s sn, %s f "+
+			"WHERE sn.id=? AND f.namespace=? AND f.deleted_at IS NULL", s.snapshotFileTableName, s.snapshotTableName, s.fileTableName),
+			id, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("INSERT INTO %s(snapshotID, fileID, chunkIndex, hash) "+
+			"SELECT sn.id, c.fileID, c.chunkIndex, c.hash FROM %s sn, %s c JOIN %s f ON f.id=c.fileID "+
+			"WHERE sn.id=? AND f.namespace=? AND f.deleted_at IS NULL", s.snapshotChunkTableName, s.snapshotTableName, s.chunkTableName, s.fileTableName),
+			id, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		return s.addBlobRefs(id, "+")
+	})
+}
+
+// chunkHashDB - key of a chunk and its hash
+type chunkHashDB struct {
+	FileID     int64          `db:"fileID"`
+	ChunkIndex int64          `db:"chunkIndex"`
+	Hash       sql.NullString `db:"hash"`
+}
+
+// saveBlobs saves the chunks of the namespace which keep their data, and
+// have no hash yet or whose blob was removed, as blobs. Deduplicated chunks
+// are blobs already.
+func (s *storage) saveBlobs() error {
+	chunks := []chunkHashDB{}
+
+	err := s.sel(&chunks, fmt.Sprintf("SELECT c.fileID, c.chunkIndex, c.hash FROM %s c JOIN %s f ON f.id=c.fileID LEFT JOIN %s b ON b.hash=c.hash "+
+		"WHERE f.namespace=? AND f.deleted_at IS NULL AND c.data IS NOT NULL AND b.hash IS NULL",
+		s.chunkTableName, s.fileTableName, s.blobTableName), s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		var data []byte
+
+		err = s.get(&data, fmt.Sprintf("SELECT data FROM %s WHERE fileID=? AND chunkIndex=?", s.chunkTableName), c.FileID, c.ChunkIndex)
+
+		if err != nil {
+			return err
+		}
+
+		// the saved data is hashed, so blobs are kept compressed and
+		// encrypted as the chunks are
+		hash := hashChunk(data)
+
+		_, err = s.exec(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(hash, data, refs) VALUES(?,?,0)", s.blobTableName)), hash, data)
+
+		if err != nil {
+			return err
+		}
+
+		if c.Hash.Valid {
+			continue
+		}
+
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET hash=? WHERE fileID=? AND chunkIndex=?", s.chunkTableName), hash, c.FileID, c.ChunkIndex)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addBlobRefs adds or subtracts, by the sign, the references of the chunks
+// of the snapshot to the reference counts of the blobs
+func (s *storage) addBlobRefs(snapshotID int64, sign string) error {
+	_, err := s.exec(fmt.Sprintf("UPDATE %s SET refs=refs%s(SELECT COUNT(*) FROM %s sc WHERE sc.snapshotID=? AND sc.hash=%s.hash) "+
+		"WHERE hash IN (SELECT hash FROM %s WHERE snapshotID=?)", s.blobTableName, sign, s.snapshotChunkTableName, s.blobTableName, s.snapshotChunkTableName),
+		snapshotID, snapshotID)
+
+	return err
+}
+
+// snapshotID returns the id of the snapshot of the namespace
+func (s *storage) snapshotID(name string) (int64, error) {
+	id := int64(0)
+
+	err := s.get(&id, fmt.Sprintf("SELECT id FROM %s WHERE namespace=? AND name=?", s.snapshotTableName), s.namespace, name)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrSnapshotNotFound
+	}
+
+	return id, err
+}
+
+// ListSnapshots returns the snapshots of the namespace, the oldest first
+func (fs *Mysqlfs) ListSnapshots() ([]SnapshotInfo, error) {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return nil, ErrSnapshotsUnsupported
+	}
+
+	err := s.ensureTables(snapshotTables...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := []SnapshotInfo{}
+
+	err = s.sel(&res, fmt.Sprintf("SELECT name, created FROM %s WHERE namespace=? ORDER BY created, id", s.snapshotTableName), s.namespace)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Restore replaces all the files of the namespace with the files of the
+// snapshot in one transaction. The snapshot is kept. Files opened before
+// fail to save their writes with ErrConcurrentModification.
+func (fs *Mysqlfs) Restore(name string) error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return ErrSnapshotsUnsupported
+	}
+
+	err := s.ensureTables(snapshotTables...)
+
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(s *storage) error {
+		id, err := s.snapshotID(name)
+
+		if err != nil {
+			return err
+		}
+
+		// the restored rows get a newer version and content version than any
+		// row they replace
+		version := int64(0)
+
+		err = s.get(&version, fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s WHERE namespace=?", s.dialect.Greatest("version", "content_version"), s.fileTableName), s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		// deleted files are kept unless the snapshot has them. The ids are
+		// selected first, MySQL can't delete from a table it selects from.
+		replaced := []int64{}
+
+		err = s.sel(&replaced, fmt.Sprintf("SELECT id FROM %s WHERE namespace=? AND (deleted_at IS NULL OR id IN (SELECT id FROM %s WHERE snapshotID=?))",
+			s.fileTableName, s.snapshotFileTableName), s.namespace, id)
+
+		if err != nil {
+			return err
+		}
+
+		err = s.removeFiles(replaced)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("INSERT INTO %s(id, namespace, parentID, name, path, flag, mode, size, mtime, ctime, uid, gid) "+
+			"SELECT sf.id, sn.namespace, sf.parentID, sf.name, sf.path, sf.flag, sf.mode, sf.size, sf.mtime, sf.ctime, sf.uid, sf.gid FROM %s sf JOIN %s sn ON sn.id=sf.snapshotID "+
+			"WHERE sf.snapshotID=?", s.fileTableName, s.snapshotFileTableName, s.snapshotTableName),
+			id)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET version=?, content_version=? WHERE namespace=? AND id IN (SELECT id FROM %s WHERE snapshotID=?)", s.fileTableName, s.snapshotFileTableName),
+			version+1, version+1, s.namespace, id)
+
+		if err != nil {
+			return err
+		}
+
+		// with dedup the restored chunks reference the blobs of the
+		// snapshot, otherwise they keep the data of the blobs
+		if s.dedup {
+			_, err = s.exec(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, hash) SELECT fileID, chunkIndex, hash FROM %s WHERE snapshotID=?",
+				s.chunkTableName, s.snapshotChunkTableName),
+				id)
+
+			if err == nil {
+				err = s.addBlobRefs(id, "+")
+			}
+		} else {
+			_, err = s.exec(fmt.Sprintf("INSERT INTO %s(fileID, chunkIndex, data, hash) SELECT sc.fileID, sc.chunkIndex, b.data, sc.hash FROM %s sc JOIN %s b ON b.hash=sc.hash WHERE sc.snapshotID=?",
+				s.chunkTableName, s.snapshotChunkTableName, s.blobTableName),
+				id)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return s.recordChange(ChangeRestore, string(separator), "")
+	})
+}
+
+// DropSnapshot removes the snapshot, the blobs which aren't shared with
+// other snapshots are removed with it
+func (fs *Mysqlfs) DropSnapshot(name string) error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return ErrSnapshotsUnsupported
+	}
+
+	err := s.ensureTables(snapshotTables...)
+
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(s *storage) error {
+		id, err := s.snapshotID(name)
+
+		if err != nil {
+			return err
+		}
+
+		err = s.dropSnapshot(id)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE refs<=0", s.blobTableName))
+
+		return err
+	})
+}
+
+// dropSnapshot removes the snapshot with the id and its references of the
+// blobs
+func (s *storage) dropSnapshot(id int64) error {
+	err := s.addBlobRefs(id, "-")
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{s.snapshotChunkTableName, s.snapshotFileTableName} {
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE snapshotID=?", table), id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE id=?", s.snapshotTableName), id)
+
+	return err
+}
+
+// removeBatch - number of files removed by one statement of removeFiles
+const removeBatch = 500
+
+// removeFiles removes the files with the ids and their content, in batches
+// of removeBatch files. A shorter batch is padded with its last id, so all
+// the batches run the same statements.
+func (s *storage) removeFiles(ids []int64) error {
+	list := strings.TrimSuffix(strings.Repeat("?,", removeBatch), ",")
+
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > removeBatch {
+			n = removeBatch
+		}
+
+		args := make([]interface{}, removeBatch)
+		for i := range args {
+			if i < n {
+				args[i] = ids[i]
+			} else {
+				args[i] = ids[n-1]
+			}
+		}
+
+		err := s.releaseBlobs(fmt.Sprintf("fileID IN (%s)", list), args...)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE fileID IN (%s)", s.chunkTableName, list), args...)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", s.fileTableName, list), args...)
+
+		if err != nil {
+			return err
+		}
+
+		ids = ids[n:]
+	}
+
+	return nil
+}
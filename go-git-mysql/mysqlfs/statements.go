@@ -0,0 +1,91 @@
+package mysqlfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrClosed - the filesystem was closed by Close
+var ErrClosed = errors.New("mysqlfs: filesystem is closed")
+
+// stmtCache - prepared statements by query. Statements are kept until the
+// storage is closed, so queries mustn't vary with the number of arguments.
+type stmtCache struct {
+	mu     sync.Mutex
+	m      map[string]*sqlx.Stmt
+	closed bool
+}
+
+// get returns the statement of the query, which is prepared on the first use
+func (c *stmtCache) get(ctx context.Context, db *sqlx.DB, query string) (*sqlx.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	if stmt, ok := c.m[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.PreparexContext(ctx, db.Rebind(query))
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.m[query] = stmt
+
+	return stmt, nil
+}
+
+// close closes all the statements, the cache can't be used after it
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res error
+
+	for _, stmt := range c.m {
+		if err := stmt.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+
+	c.m = nil
+	c.closed = true
+
+	return res
+}
+
+// stmt returns the prepared statement of the query, bound to the
+// transaction of s if there is one
+func (s *storage) stmt(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	stmt, err := s.stmts.get(ctx, s.db, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tx != nil {
+		return s.tx.StmtxContext(ctx, stmt), nil
+	}
+
+	return stmt, nil
+}
+
+// Close closes the prepared statements of the storage and all its copies,
+// they fail with ErrClosed afterwards. The db isn't closed.
+func (s *storage) Close() error {
+	return s.stmts.close()
+}
+
+// Close releases the resources of the filesystem and of all the views
+// returned by WithContext and Tx. The filesystem can't be used after it.
+func (fs *Mysqlfs) Close() error {
+	return fs.storage.Close()
+}
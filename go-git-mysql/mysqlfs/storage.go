@@ -1,210 +1,638 @@
 package mysqlfs
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
 )
 
 const separator = filepath.Separator
 
 type storage struct {
-	db            *sqlx.DB
-	fileTableName string
+	db      *sqlx.DB
+	dialect Dialect
+	// folderName - name of the files table, the names of the other tables
+	// start with it
+	folderName string
+	// the names of the tables are quoted
+	fileTableName      string
+	chunkTableName     string
+	namespaceTableName string
+	lockTableName      string
+	keyTableName       string
+	namespace          string
+	compressor         Compressor
+	keys               KeyProvider
+	keyCache           *keyCache
+	// tables of snapshots and of the content they share, see snapshot.go
+	snapshotTableName      string
+	snapshotFileTableName  string
+	snapshotChunkTableName string
+	blobTableName          string
+	// changeTableName - changelog of the namespaces, see changelog.go
+	changeTableName string
+	// cache - nil if Options.CacheSize is 0
+	cache *fileCache
+	// ctx - context of all the queries, each query is limited by
+	// queryTimeout if it isn't 0
+	ctx          context.Context
+	queryTimeout time.Duration
+	retryPolicy  RetryPolicy
+	// softDelete - removed files are kept in the table, see trash.go
+	softDelete bool
+	// dedup - chunks reference their data in the blobs, see blobs.go
+	dedup bool
+	// changelog - changes of files are recorded in changeTableName
+	changelog bool
+	// stmts - prepared statements shared by all the copies of the storage
+	stmts *stmtCache
+	// tableSet - tables created by the storage, see ensureTables
+	tableSet *tableSet
+
+	// tx - transaction all the queries of the storage are run in
+	tx *sqlx.Tx
+	// parent - storage which started tx for a single method call. Files
+	// read in such a transaction are bound to the parent, so they can be
+	// used after the transaction is committed.
+	parent *storage
 }
 
-func newStorage(dbPool *sql.DB, folderName string) (Storage, error) {
+// ErrInvalidTableName - the name of the table isn't a valid identifier
+var ErrInvalidTableName = fmt.Errorf("mysqlfs: invalid table name, it must start with a letter or an underscore, contain only letters, digits and underscores and be at most %d characters long", maxTableNameLength)
 
-	db := sqlx.NewDb(dbPool, "mysql")
+// maxTableNameLength leaves room for the suffixes of the other tables in 64
+// characters of a MySQL identifier
+const maxTableNameLength = 48
 
-	_, err := db.Exec(
-		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s 
-		(id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY, 
-			parentID BIGINT,
-			name varchar(255) NOT NULL, 
-			path varchar(255) NOT NULL, 
-			flag INT, 
-			mode BIGINT, 
-			content LONGBLOB,
-			UNIQUE (path),
-			INDEX (path),
-			INDEX (parentID))`, folderName))
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidTableName reports if name can be used as the table of a filesystem
+func ValidTableName(name string) bool {
+	return len(name) <= maxTableNameLength && tableNameRegexp.MatchString(name)
+}
+
+// newStorage opens the storage of the table folderName, creating the tables
+// of the enabled features which don't exist yet and upgrading the tables of
+// older versions
+func newStorage(dbPool *sql.DB, folderName string, options Options) (*storage, error) {
+	s, err := openStorage(dbPool, folderName, options)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &storage{db: db, fileTableName: folderName}, nil
-}
+	tables := append([]string{}, coreTables...)
+	if options.Namespace != "" {
+		tables = append(tables, namespaceTables...)
+	}
 
-func (s *storage) GetFile(path string) (*File, error) {
-	path = clean(path)
-	f := FileDB{}
+	if options.KeyProvider != nil {
+		tables = append(tables, keyTables...)
+	}
+
+	if options.Dedup {
+		tables = append(tables, blobTables...)
+	}
+
+	if options.Changelog {
+		tables = append(tables, changeTables...)
+	}
 
-	err := s.db.Get(&f, fmt.Sprintf("SELECT * FROM %s WHERE path = ?", s.fileTableName), path)
+	err = s.ensureTables(tables...)
+
+	if err == nil {
+		err = s.migrateContent()
+	}
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
+		return nil, err
+	}
 
+	return s, nil
+}
+
+// openExisting returns the storage of the table folderName for the
+// functions which mustn't change the tables, the tables must exist and be
+// upgraded by newStorage before
+func openExisting(dbPool *sql.DB, folderName string, options Options) (*storage, error) {
+	s, err := openStorage(dbPool, folderName, options)
+
+	if err != nil {
 		return nil, err
 	}
 
-	return fileDBtoFile(&f, s), nil
+	err = s.checkTables(coreTables...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
-func (s *storage) GetFileID(path string) (int64, error) {
-	path = clean(path)
-	id := int64(0)
+// openStorage returns the storage of the table folderName without touching
+// the tables
+func openStorage(dbPool *sql.DB, folderName string, options Options) (*storage, error) {
+	if !ValidTableName(folderName) {
+		return nil, ErrInvalidTableName
+	}
+
+	dialect := options.Dialect
+	if dialect == nil {
+		dialect = detectDialect(dbPool)
+	}
+
+	db := sqlx.NewDb(dbPool, dialect.DriverName())
+
+	if dialect.FoldsNames() {
+		db.Mapper = reflectx.NewMapperTagFunc("db", strings.ToLower, strings.ToLower)
+	}
+
+	s := &storage{
+		db:                     db,
+		dialect:                dialect,
+		folderName:             folderName,
+		fileTableName:          dialect.Quote(folderName),
+		chunkTableName:         dialect.Quote(folderName + "_chunks"),
+		namespaceTableName:     dialect.Quote(folderName + "_namespaces"),
+		lockTableName:          dialect.Quote(folderName + "_locks"),
+		keyTableName:           dialect.Quote(folderName + "_keys"),
+		snapshotTableName:      dialect.Quote(folderName + "_snapshots"),
+		snapshotFileTableName:  dialect.Quote(folderName + "_snapshot_files"),
+		snapshotChunkTableName: dialect.Quote(folderName + "_snapshot_chunks"),
+		blobTableName:          dialect.Quote(folderName + "_blobs"),
+		changeTableName:        dialect.Quote(folderName + "_changes"),
+		namespace:              options.Namespace,
+		compressor:             options.Compression,
+		keys:                   options.KeyProvider,
+		keyCache:               &keyCache{m: map[string][]byte{}},
+		ctx:                    context.Background(),
+		queryTimeout:           options.QueryTimeout,
+		retryPolicy:            options.Retry,
+		softDelete:             options.SoftDelete,
+		dedup:                  options.Dedup,
+		changelog:              options.Changelog,
+		stmts:                  &stmtCache{m: map[string]*sqlx.Stmt{}},
+		tableSet:               &tableSet{created: map[string]bool{}},
+	}
+
+	if options.CacheSize > 0 {
+		s.cache = newFileCache(options.CacheSize)
+	}
+
+	return s, nil
+}
 
-	err := s.db.Get(&id, fmt.Sprintf("SELECT id FROM %s WHERE path = ?", s.fileTableName), path)
+// begin starts a transaction and returns a storage bound to it. Files read
+// through the returned storage are bound to the transaction too.
+func (s *storage) begin() (*storage, error) {
+	tx, err := s.db.BeginTxx(s.ctx, nil)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil
+		return nil, s.ctxErr(s.ctx, err)
+	}
+
+	txs := *s
+	txs.tx = tx
+	txs.parent = nil
+
+	return &txs, nil
+}
+
+// withTx runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise. If the storage is already bound to a transaction,
+// fn joins it. The transaction is replayed by the retry policy.
+func (s *storage) withTx(fn func(s *storage) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	var txs *storage
+
+	err := s.retry(func() error {
+		var err error
+		txs, err = s.begin()
+
+		if err != nil {
+			return err
 		}
 
-		return 0, err
+		txs.parent = s
+
+		err = fn(txs)
+
+		if err != nil {
+			txs.tx.Rollback()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return err
 	}
 
-	return id, nil
+	// a failed commit isn't retried, the transaction could be committed
+	// before the connection was lost
+	return s.ctxErr(s.ctx, txs.tx.Commit())
 }
 
-func (s *storage) NewFile(path string, mode os.FileMode, flag int) (*File, error) {
-	path = clean(path)
+// Tx runs fn in a transaction. Unlike withTx, files read in fn are bound to
+// the transaction, so they must not be used after fn returns.
+func (s *storage) Tx(fn func(s Storage) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	var txs *storage
+
+	err := s.retry(func() (err error) {
+		txs, err = s.begin()
+
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				txs.tx.Rollback()
+				panic(r)
+			}
+		}()
+
+		err = fn(txs)
+
+		if err != nil {
+			txs.tx.Rollback()
+		}
 
-	f, err := s.GetFile(path)
+		return err
+	})
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if f != nil {
-		if !f.Mode.IsDir() {
-			return nil, fmt.Errorf("file already exists %q", path)
-		}
+	return s.ctxErr(s.ctx, txs.tx.Commit())
+}
 
-		return nil, nil
+// fileStorage returns the storage files read by s must be bound to
+func (s *storage) fileStorage() *storage {
+	if s.parent != nil {
+		return s.parent
 	}
 
-	fDB := &FileDB{
-		Name:    filepath.Base(path),
-		Path:    path,
-		Content: []byte{},
-		Mode:    int64(mode),
-		Flag:    flag,
+	return s
+}
+
+// the queries are written with "?" bind variables, which are rebound for
+// the db. Each query is prepared once and the statement is reused.
+
+func (s *storage) get(dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+
+	stmt, err := s.stmt(ctx, query)
+
+	if err == nil {
+		err = stmt.GetContext(ctx, dest, args...)
 	}
 
-	f = &File{
-		FileName: fDB.Name,
-		Path:     fDB.Path,
-		Content:  fDB.Content,
-		Mode:     mode,
-		Flag:     fDB.Flag,
-		storage:  s,
+	if err == nil {
+		s.stats().addRows(1)
 	}
 
-	stmtIns, err := s.db.Prepare(fmt.Sprintf("INSERT INTO %s(name,path,mode,flag, content) VALUES(?,?,?,?,?)", s.fileTableName))
-	if err != nil {
-		return nil, err
+	return s.ctxErr(ctx, err)
+}
+
+func (s *storage) sel(dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+
+	stmt, err := s.stmt(ctx, query)
+
+	if err == nil {
+		err = stmt.SelectContext(ctx, dest, args...)
 	}
 
-	defer stmtIns.Close()
+	if err == nil {
+		s.stats().addRows(int64(reflect.ValueOf(dest).Elem().Len()))
+	}
 
-	res, err := stmtIns.Exec(fDB.Name, fDB.Path, fDB.Mode, fDB.Flag, fDB.Content)
+	return s.ctxErr(ctx, err)
+}
+
+// queryx runs the query, the query context is released when the rows are
+// closed
+func (s *storage) queryx(query string, args ...interface{}) (*queryRows, error) {
+	ctx, cancel := s.queryContext()
+
+	var rows *sqlx.Rows
+	stmt, err := s.stmt(ctx, query)
+
+	if err == nil {
+		rows, err = stmt.QueryxContext(ctx, args...)
+	}
 
 	if err != nil {
-		return nil, err
+		cancel()
+		return nil, s.ctxErr(ctx, err)
 	}
 
-	id, err := res.LastInsertId()
+	return &queryRows{Rows: rows, s: s, ctx: ctx, cancel: cancel}, nil
+}
 
-	if err != nil {
-		return nil, err
+func (s *storage) exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+
+	var r sql.Result
+	stmt, err := s.stmt(ctx, query)
+
+	if err == nil {
+		r, err = stmt.ExecContext(ctx, args...)
+	}
+
+	if err == nil {
+		if n, errRows := r.RowsAffected(); errRows == nil {
+			s.stats().addRows(n)
+		}
 	}
 
-	f.ID = id
+	return r, s.ctxErr(ctx, err)
+}
+
+// insert runs INSERT statement and returns the id of the new row
+func (s *storage) insert(query string, args ...interface{}) (int64, error) {
+	if s.dialect.ReturningID() {
+		id := int64(0)
+		err := s.get(&id, query+" RETURNING id", args...)
+
+		return id, err
+	}
 
-	err = s.CreateParentAddToFile(path, mode, f)
+	r, err := s.exec(query, args...)
 
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return f, nil
+	return r.LastInsertId()
 }
 
-func (s *storage) Children(path string) ([]*File, error) {
+func (s *storage) GetFile(path string) (*File, error) {
 	path = clean(path)
+	var res *File
 
-	if path == "" || path == string(filepath.Separator) {
+	if s.cache != nil && s.tx == nil {
+		f, err := s.getCachedFile(path)
 
-		resDB := []FileDB{}
-		err := s.db.Select(&resDB, fmt.Sprintf("SELECT * FROM %s WHERE parentID IS NULL", s.fileTableName))
+		if err != nil || f == nil {
+			return nil, err
+		}
+
+		return fileDBtoFile(f, s), nil
+	}
+
+	err := s.withTx(func(s *storage) error {
+		f := FileDB{}
+
+		err := s.get(&f, fmt.Sprintf("SELECT %s FROM %s WHERE path = ? AND namespace=? AND deleted_at IS NULL", fileColumns, s.fileTableName), path, s.namespace)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return []*File{}, nil
+				return nil
 			}
-			return nil, err
+
+			return err
 		}
 
-		res := make([]*File, 0)
-		for _, fDB := range resDB {
-			f := fileDBtoFile(&fDB, s)
-			res = append(res, f)
+		res = fileDBtoFile(&f, s.fileStorage())
+
+		return nil
+	})
+
+	return res, err
+}
+
+// GetFileByID returns the file with the id, nil if it doesn't exist or is
+// deleted
+func (s *storage) GetFileByID(id int64) (*File, error) {
+	var res *File
+
+	err := s.withTx(func(s *storage) error {
+		f := FileDB{}
+
+		err := s.get(&f, fmt.Sprintf("SELECT %s FROM %s WHERE id=? AND namespace=? AND deleted_at IS NULL", fileColumns, s.fileTableName), id, s.namespace)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+
+			return err
 		}
 
-		return res, nil
-	}
+		res = fileDBtoFile(&f, s.fileStorage())
 
-	parentID := int64(0)
+		return nil
+	})
 
-	err := s.db.Get(&parentID, fmt.Sprintf("SELECT id FROM %s WHERE path=?", s.fileTableName), path)
+	return res, err
+}
+
+func (s *storage) GetFileID(path string) (int64, error) {
+	path = clean(path)
+	id := int64(0)
+
+	err := s.withTx(func(s *storage) error {
+		err := s.get(&id, fmt.Sprintf("SELECT id FROM %s WHERE path = ? AND namespace=? AND deleted_at IS NULL", s.fileTableName), path, s.namespace)
 
-	if err != nil {
 		if err == sql.ErrNoRows {
-			return []*File{}, nil
+			return nil
+		}
+
+		return err
+	})
+
+	return id, err
+}
+
+func (s *storage) NewFile(path string, mode os.FileMode, flag int) (*File, error) {
+	path = clean(path)
+	var res *File
+
+	err := s.withTx(func(s *storage) error {
+		f, err := s.GetFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		if f != nil {
+			if !f.Mode.IsDir() {
+				return fmt.Errorf("file already exists %q", path)
+			}
+
+			return nil
+		}
+
+		// the parent is created first, so the file is inserted with its
+		// parentID right away
+		parent, err := createParent(s, path, mode)
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		fDB := &FileDB{
+			Name:  filepath.Base(path),
+			Path:  path,
+			Mode:  int64(mode),
+			Flag:  flag,
+			MTime: now.UnixNano(),
+			CTime: now.UnixNano(),
+		}
+
+		if parent != nil {
+			fDB.ParentID = sql.NullInt64{Int64: parent.ID, Valid: true}
+		}
+
+		fDB.ID, err = s.insert(fmt.Sprintf("INSERT INTO %s(namespace,parentID,name,path,mode,flag,mtime,ctime) VALUES(?,?,?,?,?,?,?,?)", s.fileTableName),
+			s.namespace, fDB.ParentID, fDB.Name, fDB.Path, fDB.Mode, fDB.Flag, fDB.MTime, fDB.CTime)
+
+		if err != nil {
+			return err
 		}
+
+		err = s.recordChange(ChangeCreate, path, "")
+
+		if err != nil {
+			return err
+		}
+
+		res = fileDBtoFile(fDB, s.fileStorage())
+
+		return nil
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
-	return s.ChildrenByFileID(parentID)
+	return res, nil
 }
 
-func (s *storage) ChildrenIds(path string) ([]int64, error) {
+func (s *storage) Children(path string) ([]*File, error) {
 	path = clean(path)
-	parentID := int64(0)
+	var res []*File
 
-	err := s.db.Get(&parentID, fmt.Sprintf("SELECT id FROM %s WHERE path=?", s.fileTableName), path)
+	err := s.withTx(func(s *storage) error {
+		if path == "" || path == string(filepath.Separator) {
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return []int64{}, nil
+			resDB := []FileDB{}
+			err := s.sel(&resDB, fmt.Sprintf("SELECT %s FROM %s WHERE parentID IS NULL AND namespace=? AND deleted_at IS NULL", fileColumns, s.fileTableName), s.namespace)
+
+			if err != nil {
+				return err
+			}
+
+			res = make([]*File, 0)
+			for _, fDB := range resDB {
+				f := fileDBtoFile(&fDB, s.fileStorage())
+				res = append(res, f)
+			}
+
+			return nil
 		}
+
+		parentID := int64(0)
+
+		err := s.get(&parentID, fmt.Sprintf("SELECT id FROM %s WHERE path=? AND namespace=?", s.fileTableName), path, s.namespace)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				res = []*File{}
+				return nil
+			}
+			return err
+		}
+
+		res, err = s.ChildrenByFileID(parentID)
+
+		return err
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
-	return s.ChildrenIdsByFileID(parentID)
+	return res, nil
 }
 
-func (s *storage) ChildrenByFileID(id int64) ([]*File, error) {
-	resDB := []FileDB{}
-	err := s.db.Select(&resDB, fmt.Sprintf("SELECT * FROM %s WHERE parentID=?", s.fileTableName), id)
+func (s *storage) ChildrenIds(path string) ([]int64, error) {
+	path = clean(path)
+	var res []int64
+
+	err := s.withTx(func(s *storage) error {
+		parentID := int64(0)
+
+		err := s.get(&parentID, fmt.Sprintf("SELECT id FROM %s WHERE path=? AND namespace=?", s.fileTableName), path, s.namespace)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				res = []int64{}
+				return nil
+			}
+			return err
+		}
+
+		res, err = s.ChildrenIdsByFileID(parentID)
+
+		return err
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	res := make([]*File, 0)
-	for _, fDB := range resDB {
-		f := fileDBtoFile(&fDB, s)
-		res = append(res, f)
+	return res, nil
+}
+
+func (s *storage) ChildrenByFileID(id int64) ([]*File, error) {
+	var res []*File
+
+	err := s.withTx(func(s *storage) error {
+		resDB := []FileDB{}
+		err := s.sel(&resDB, fmt.Sprintf("SELECT %s FROM %s WHERE parentID=? AND namespace=? AND deleted_at IS NULL", fileColumns, s.fileTableName), id, s.namespace)
+
+		if err != nil {
+			return err
+		}
+
+		res = make([]*File, 0)
+		for _, fDB := range resDB {
+			f := fileDBtoFile(&fDB, s.fileStorage())
+			res = append(res, f)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return res, nil
@@ -212,7 +640,10 @@ func (s *storage) ChildrenByFileID(id int64) ([]*File, error) {
 
 func (s *storage) ChildrenIdsByFileID(id int64) ([]int64, error) {
 	res := []int64{}
-	err := s.db.Select(&res, fmt.Sprintf("SELECT id FROM %s WHERE parentID=?", s.fileTableName), id)
+
+	err := s.withTx(func(s *storage) error {
+		return s.sel(&res, fmt.Sprintf("SELECT id FROM %s WHERE parentID=? AND namespace=? AND deleted_at IS NULL", s.fileTableName), id, s.namespace)
+	})
 
 	if err != nil {
 		return nil, err
@@ -224,167 +655,163 @@ func (s *storage) ChildrenIdsByFileID(id int64) ([]int64, error) {
 func (s *storage) RenameFile(from, to string) error {
 	from = clean(from)
 	to = clean(to)
-	f, err := s.GetFile(from)
 
-	if err != nil {
-		return err
-	}
-
-	if f == nil {
-		return os.ErrNotExist
+	if from == to {
+		return nil
 	}
 
-	newName := filepath.Base(to)
-
-	if f.Mode.IsDir() {
+	return s.withTx(func(s *storage) error {
+		f, err := s.GetFile(from)
 
-		children, err := s.ChildrenByFileID(f.ID)
 		if err != nil {
 			return err
 		}
 
-		tx := s.db.MustBegin()
-		tx.MustExec(fmt.Sprintf("UPDATE %s SET name=?, path=? WHERE id=?", s.fileTableName), newName, to, f.ID)
-
-		if len(children) != 0 {
-			for _, c := range children {
-				tx.MustExec(fmt.Sprintf("UPDATE %s SET path=? WHERE id=?", s.fileTableName), filepath.Join(to, c.FileName), c.ID)
-			}
+		if f == nil {
+			return os.ErrNotExist
 		}
 
-		err = tx.Commit()
-
-		if err != nil {
-			return err
+		if f.Mode.IsDir() && strings.HasPrefix(to, from+string(separator)) {
+			return fmt.Errorf("can't rename dir %q into its descendant %q", from, to)
 		}
 
-	} else {
-
-		s.RemoveFile(to)
-
-		newParentID, err := s.GetFileID(filepath.Dir(to))
+		target, err := s.GetFile(to)
 
 		if err != nil {
 			return err
 		}
 
-		if newParentID != 0 {
-			stmt, err := s.db.Prepare(fmt.Sprintf("UPDATE %s SET name=?, path=?, parentID=? WHERE id=?", s.fileTableName))
-
-			if err != nil {
-				return err
+		if target != nil {
+			if f.Mode.IsDir() && !target.Mode.IsDir() {
+				return fmt.Errorf("can't replace file %q with dir %q", to, from)
 			}
 
-			defer stmt.Close()
+			if !f.Mode.IsDir() && target.Mode.IsDir() {
+				return fmt.Errorf("can't replace dir %q with file %q", to, from)
+			}
 
-			_, err = stmt.Exec(newName, to, newParentID, f.ID)
+			// RemoveFile fails if the target is a dir which contains files
+			err = s.RemoveFile(to)
 
 			if err != nil {
 				return err
 			}
-
-			return nil
 		}
 
-		newParent, err := createParent(s, to, 0644)
+		newParentID, err := s.GetFileID(filepath.Dir(to))
 
 		if err != nil {
 			return err
 		}
 
-		if newParent == nil {
-			stmt, err := s.db.Prepare(fmt.Sprintf("UPDATE %s SET name=?, path=?, parentID=? WHERE id=?", s.fileTableName))
+		if newParentID == 0 {
+			newParent, err := createParent(s, to, 0644)
 
 			if err != nil {
 				return err
 			}
 
-			defer stmt.Close()
-
-			_, err = stmt.Exec(newName, to, nil, f.ID)
-		} else {
-			stmt, err := s.db.Prepare(fmt.Sprintf("UPDATE %s SET name=?, path=?, parentID=? WHERE id=?", s.fileTableName))
-
-			if err != nil {
-				return err
+			if newParent != nil {
+				newParentID = newParent.ID
 			}
+		}
 
-			defer stmt.Close()
+		parentID := sql.NullInt64{Int64: newParentID, Valid: newParentID != 0}
 
-			_, err = stmt.Exec(newName, to, newParent.ID, f.ID)
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET name=?, path=?, parentID=?, ctime=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName),
+			filepath.Base(to), to, parentID, time.Now().UnixNano(), f.ID, s.namespace)
+
+		if err != nil {
+			return err
 		}
 
+		err = s.recordChange(ChangeRename, to, from)
+
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		if !f.Mode.IsDir() {
+			return nil
+		}
+
+		// the paths of the whole subtree are rewritten at once, parentIDs
+		// inside the subtree stay the same
+		_, err = s.exec(
+			fmt.Sprintf("UPDATE %s SET path=%s, version=version+1 WHERE path LIKE ? ESCAPE '!' AND namespace=?",
+				s.fileTableName, s.dialect.Concat(s.dialect.Text("?"), fmt.Sprintf("SUBSTR(path, %s + 1)", s.dialect.CharLength(s.dialect.Text("?"))))),
+			to, from, escapeLike(from+string(separator))+"%", s.namespace)
+
+		return err
+	})
+}
+
+// escapeLike escapes the wildcards of LIKE pattern in s
+func escapeLike(s string) string {
+	return likeReplacer.Replace(s)
 }
 
+var likeReplacer = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
 func (s *storage) RemoveFile(path string) error {
 	path = clean(path)
 
-	f, err := s.GetFile(path)
+	return s.withTx(func(s *storage) error {
+		f, err := s.GetFile(path)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if f == nil {
-		return os.ErrNotExist
-	}
+		if f == nil {
+			return os.ErrNotExist
+		}
 
-	childrenIds, err := s.ChildrenIdsByFileID(f.ID)
+		childrenIds, err := s.ChildrenIdsByFileID(f.ID)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	childrenIdsLen := len(childrenIds)
+		childrenIdsLen := len(childrenIds)
 
-	if f.Mode.IsDir() && childrenIdsLen != 0 {
-		return fmt.Errorf("dir: %s contains files", path)
-	}
+		if f.Mode.IsDir() && childrenIdsLen != 0 {
+			return fmt.Errorf("dir: %s contains files", path)
+		}
 
-	stmt, err := s.db.Prepare(fmt.Sprintf("DELETE FROM %s where id=?", s.fileTableName))
-	if err != nil {
-		return err
-	}
+		err = s.recordChange(ChangeRemove, path, "")
 
-	defer stmt.Close()
+		if err != nil {
+			return err
+		}
 
-	_, err = stmt.Exec(f.ID)
+		if s.softDelete {
+			return s.moveToTrash(f)
+		}
 
-	if err != nil {
-		return err
-	}
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s where id=? AND namespace=?", s.fileTableName), f.ID, s.namespace)
 
-	return nil
-}
+		if err != nil {
+			return err
+		}
 
-func (s *storage) UpdateFileContent(fileID int64, content []byte) error {
-	stmt, err := s.db.Prepare(fmt.Sprintf("UPDATE %s SET content=? WHERE id=?", s.fileTableName))
-	if err != nil {
-		return err
-	}
+		err = s.releaseBlobs("fileID=?", f.ID)
 
-	defer stmt.Close()
+		if err != nil {
+			return err
+		}
 
-	_, err = stmt.Exec(content, fileID)
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE fileID=?", s.chunkTableName), f.ID)
 
-	if err != nil {
 		return err
-	}
-
-	return nil
+	})
 }
 
 func createParent(s Storage, path string, mode os.FileMode) (*File, error) {
 	base := filepath.Dir(path)
 	base = clean(base)
 
-	if base == string(separator) {
+	if base == string(separator) || base == "." {
 
 		return nil, nil
 	}
@@ -407,35 +834,50 @@ func createParent(s Storage, path string, mode os.FileMode) (*File, error) {
 }
 
 func (s *storage) CreateParentAddToFile(path string, mode os.FileMode, f *File) error {
-	parent, err := createParent(s, path, mode)
+	return s.withTx(func(s *storage) error {
+		parent, err := createParent(s, path, mode)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if parent == nil {
-		return nil
-	}
+		if parent == nil {
+			return nil
+		}
 
-	f.ParentID = parent.ID
+		f.ParentID = parent.ID
+
+		_, err = s.exec(fmt.Sprintf("UPDATE %s SET parentID=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName), parent.ID, f.ID, s.namespace)
 
-	stmt, err := s.db.Prepare(fmt.Sprintf("UPDATE %s SET parentID=? WHERE id=?", s.fileTableName))
-	if err != nil {
 		return err
-	}
+	})
+}
+
+func (s *storage) UpdateFileMode(fileID int64, mode os.FileMode) error {
+	return s.withTx(func(s *storage) error {
+		_, err := s.exec(fmt.Sprintf("UPDATE %s SET mode=?, ctime=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName), int64(mode), time.Now().UnixNano(), fileID, s.namespace)
 
-	defer stmt.Close()
+		return err
+	})
+}
 
-	_, err = stmt.Exec(parent.ID, f.ID)
+func (s *storage) UpdateFileOwner(fileID int64, uid, gid int) error {
+	return s.withTx(func(s *storage) error {
+		_, err := s.exec(fmt.Sprintf("UPDATE %s SET uid=?, gid=?, ctime=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName), uid, gid, time.Now().UnixNano(), fileID, s.namespace)
 
-	if err != nil {
 		return err
-	}
+	})
+}
+
+func (s *storage) UpdateFileModTime(fileID int64, mtime time.Time) error {
+	return s.withTx(func(s *storage) error {
+		_, err := s.exec(fmt.Sprintf("UPDATE %s SET mtime=?, ctime=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName), mtime.UnixNano(), time.Now().UnixNano(), fileID, s.namespace)
 
-	return nil
+		return err
+	})
 }
 
-func fileDBtoFile(f *FileDB, s *storage) *File {
+func fileDBtoFile(f *FileDB, s Storage) *File {
 	if f == nil {
 		return nil
 	}
@@ -450,10 +892,18 @@ func fileDBtoFile(f *FileDB, s *storage) *File {
 		FileName: f.Name,
 		ParentID: parID,
 		Path:     f.Path,
-		Content:  f.Content,
+		Size:     f.Size,
 		Flag:     f.Flag,
 		Mode:     os.FileMode(f.Mode),
 		storage:  s,
+
+		ModTime:    time.Unix(0, f.MTime),
+		ChangeTime: time.Unix(0, f.CTime),
+		UID:        f.UID,
+		GID:        f.GID,
+		Version:    f.Version,
+
+		ContentVersion: f.ContentVersion,
 	}
 }
 
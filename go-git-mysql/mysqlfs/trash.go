@@ -0,0 +1,226 @@
+package mysqlfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrSoftDeleteUnsupported - the storage of the filesystem doesn't keep
+// deleted files
+var ErrSoftDeleteUnsupported = errors.New("mysqlfs: soft delete isn't supported by the storage")
+
+// DeletedFile - a file in the trash
+type DeletedFile struct {
+	ID int64 `db:"id"`
+	// Path - the path the file had when it was deleted
+	Path string `db:"deleted_path"`
+	Size int64  `db:"size"`
+	Mode int64  `db:"mode"`
+	// DeletedAt - unix time of the deletion in nanoseconds
+	DeletedAt int64 `db:"deleted_at"`
+}
+
+// trashPath - unique path of the deleted file, which frees its path. It
+// doesn't start with the separator, so it isn't found by any absolute path.
+func trashPath(id int64) string {
+	return fmt.Sprintf("deleted:%d", id)
+}
+
+// moveToTrash marks the file deleted, it keeps its content and parentID
+func (s *storage) moveToTrash(f *File) error {
+	_, err := s.exec(fmt.Sprintf("UPDATE %s SET path=?, deleted_path=?, deleted_at=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName),
+		trashPath(f.ID), f.Path, time.Now().UnixNano(), f.ID, s.namespace)
+
+	return err
+}
+
+// ListDeleted returns the files in the trash of the namespace, the latest
+// deleted first
+func (fs *Mysqlfs) ListDeleted() ([]DeletedFile, error) {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return nil, ErrSoftDeleteUnsupported
+	}
+
+	return s.listDeleted(0)
+}
+
+// listDeleted returns the files deleted at since or later
+func (s *storage) listDeleted(since int64) ([]DeletedFile, error) {
+	res := []DeletedFile{}
+
+	err := s.sel(&res, fmt.Sprintf("SELECT id, deleted_path, size, mode, deleted_at FROM %s WHERE namespace=? AND deleted_at>=? ORDER BY deleted_at DESC, id DESC", s.fileTableName),
+		s.namespace, since)
+
+	return res, err
+}
+
+// Undelete restores the deleted file with the id at path, empty path means
+// the path the file had. Missing dirs of the path are created. If a file
+// with the path exists, os.ErrExist is returned.
+func (fs *Mysqlfs) Undelete(id int64, path string) error {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return ErrSoftDeleteUnsupported
+	}
+
+	return s.withTx(func(s *storage) error {
+		f := DeletedFile{}
+
+		err := s.get(&f, fmt.Sprintf("SELECT id, deleted_path, size, mode, deleted_at FROM %s WHERE id=? AND namespace=? AND deleted_at IS NOT NULL", s.fileTableName),
+			id, s.namespace)
+
+		if err == sql.ErrNoRows {
+			return os.ErrNotExist
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if path == "" {
+			path = f.Path
+		}
+
+		return s.undelete(id, clean(path))
+	})
+}
+
+// UndeleteSince restores all the files deleted at t or later, e.g. by a
+// mistaken cleanup. A path deleted several times gets its latest deleted
+// file. Paths which exist again are skipped. The number of restored files
+// is returned.
+func (fs *Mysqlfs) UndeleteSince(t time.Time) (int, error) {
+	s, ok := fs.storage.(*storage)
+
+	if !ok {
+		return 0, ErrSoftDeleteUnsupported
+	}
+
+	n := 0
+
+	err := s.withTx(func(s *storage) error {
+		n = 0
+
+		files, err := s.listDeleted(t.UnixNano())
+
+		if err != nil {
+			return err
+		}
+
+		latest := []DeletedFile{}
+		seen := map[string]bool{}
+
+		for _, f := range files {
+			if !seen[f.Path] {
+				seen[f.Path] = true
+				latest = append(latest, f)
+			}
+		}
+
+		// dirs are restored before the files in them
+		sort.SliceStable(latest, func(i, j int) bool { return len(latest[i].Path) < len(latest[j].Path) })
+
+		for _, f := range latest {
+			err = s.undelete(f.ID, f.Path)
+
+			if err == os.ErrExist {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// undelete moves the deleted file to path
+func (s *storage) undelete(id int64, path string) error {
+	existing, err := s.GetFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return os.ErrExist
+	}
+
+	parent, err := createParent(s, path, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	parentID := sql.NullInt64{}
+	if parent != nil {
+		parentID = sql.NullInt64{Int64: parent.ID, Valid: true}
+	}
+
+	_, err = s.exec(fmt.Sprintf("UPDATE %s SET name=?, path=?, parentID=?, deleted_at=NULL, deleted_path=NULL, ctime=?, version=version+1 WHERE id=? AND namespace=?", s.fileTableName),
+		filepath.Base(path), path, parentID, time.Now().UnixNano(), id, s.namespace)
+
+	if err != nil {
+		return err
+	}
+
+	return s.recordChange(ChangeCreate, path, "")
+}
+
+// PurgeDeleted removes the files which were deleted longer than retention
+// ago from all the namespaces of the table folderName, with their content.
+// The number of removed files is returned.
+func PurgeDeleted(db *sql.DB, folderName string, retention time.Duration) (int64, error) {
+	s, err := openExisting(db, folderName, Options{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer s.Close()
+
+	n := int64(0)
+	before := time.Now().Add(-retention).UnixNano()
+
+	err = s.withTx(func(s *storage) error {
+		deleted := fmt.Sprintf("fileID IN (SELECT id FROM %s WHERE deleted_at<?)", s.fileTableName)
+
+		err := s.releaseBlobs(deleted, before)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE %s", s.chunkTableName, deleted), before)
+
+		if err != nil {
+			return err
+		}
+
+		r, err := s.exec(fmt.Sprintf("DELETE FROM %s WHERE deleted_at<?", s.fileTableName), before)
+
+		if err != nil {
+			return err
+		}
+
+		n, err = r.RowsAffected()
+
+		return err
+	})
+
+	return n, err
+}
@@ -0,0 +1,45 @@
+package mysqlstorage
+
+import (
+	"gopkg.in/src-d/go-git.v4/config"
+)
+
+// Config returns the saved config or a new one if it was never saved
+func (s *Storage) Config() (*config.Config, error) {
+	cfg := config.NewConfig()
+
+	content, err := s.getSingleRow(s.configTable)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) == 0 {
+		return cfg, nil
+	}
+
+	err = cfg.Unmarshal(content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// SetConfig validates and saves the config
+func (s *Storage) SetConfig(cfg *config.Config) error {
+	err := cfg.Validate()
+
+	if err != nil {
+		return err
+	}
+
+	content, err := cfg.Marshal()
+
+	if err != nil {
+		return err
+	}
+
+	return s.setSingleRow(s.configTable, content)
+}
@@ -0,0 +1,45 @@
+package mysqlstorage
+
+import (
+	"bytes"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+)
+
+// SetIndex encodes the index and saves it
+func (s *Storage) SetIndex(idx *index.Index) error {
+	buf := &bytes.Buffer{}
+
+	err := index.NewEncoder(buf).Encode(idx)
+
+	if err != nil {
+		return err
+	}
+
+	return s.setSingleRow(s.indexTable, buf.Bytes())
+}
+
+// Index returns the saved index or an empty one if it was never saved
+func (s *Storage) Index() (*index.Index, error) {
+	idx := &index.Index{
+		Version: 2,
+	}
+
+	content, err := s.getSingleRow(s.indexTable)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) == 0 {
+		return idx, nil
+	}
+
+	err = index.NewDecoder(bytes.NewReader(content)).Decode(idx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,51 @@
+package mysqlstorage
+
+import (
+	"strings"
+)
+
+// MERGE_HEAD is a regular reference and is kept in the references table
+// together with HEAD and ORIG_HEAD. The merge message has its own table.
+
+// SetMergeMsg saves the content of MERGE_MSG
+func (s *Storage) SetMergeMsg(msg string) error {
+	return s.setSingleRow(s.mergeTable, []byte(msg))
+}
+
+// MergeMsgFileContent returns the content of MERGE_MSG as it was saved,
+// including the comment lines
+func (s *Storage) MergeMsgFileContent() (string, error) {
+	content, err := s.getSingleRow(s.mergeTable)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// MergeMsg returns the content of MERGE_MSG without the lines which begin
+// from "#"
+func (s *Storage) MergeMsg() (string, error) {
+	content, err := s.MergeMsgFileContent()
+
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for _, l := range strings.Split(content, "\n") {
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// RemoveMergeMsg removes MERGE_MSG
+func (s *Storage) RemoveMergeMsg() error {
+	return s.removeSingleRow(s.mergeTable)
+}
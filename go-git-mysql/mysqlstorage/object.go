@@ -0,0 +1,142 @@
+package mysqlstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// objectDB - db object for saving git objects
+type objectDB struct {
+	Hash    string `db:"hash"`
+	Type    int8   `db:"type"`
+	Size    int64  `db:"size"`
+	Content []byte `db:"content"`
+}
+
+// NewEncodedObject returns a new in-memory object to be filled and saved by
+// SetEncodedObject
+func (s *Storage) NewEncodedObject() plumbing.EncodedObject {
+	return &plumbing.MemoryObject{}
+}
+
+// SetEncodedObject saves the object. Objects are immutable, so saving an
+// already stored hash is a no-op.
+func (s *Storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if obj.Type() == plumbing.OFSDeltaObject || obj.Type() == plumbing.REFDeltaObject {
+		return plumbing.ZeroHash, plumbing.ErrInvalidType
+	}
+
+	r, err := obj.Reader()
+
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	h := obj.Hash()
+
+	_, err = s.db.Exec(
+		s.db.Rebind(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(hash, type, size, content) VALUES(?,?,?,?)", s.objectsTable))),
+		h.String(), int8(obj.Type()), obj.Size(), content)
+
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return h, nil
+}
+
+// EncodedObject returns the object with the given hash. If t is not
+// plumbing.AnyObject and the stored object has another type,
+// plumbing.ErrObjectNotFound is returned.
+func (s *Storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	o := objectDB{}
+
+	err := s.db.Get(&o, s.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE hash = ?", s.objectsTable)), h.String())
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, plumbing.ErrObjectNotFound
+		}
+
+		return nil, err
+	}
+
+	ot := plumbing.ObjectType(o.Type)
+
+	if t != plumbing.AnyObject && ot != t {
+		return nil, plumbing.ErrObjectNotFound
+	}
+
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(ot)
+
+	_, err = obj.Write(o.Content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// IterEncodedObjects returns an iterator over the objects of the given type.
+// Only hashes are fetched up front, objects are loaded one by one.
+func (s *Storage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	hashes := []string{}
+	var err error
+
+	if t == plumbing.AnyObject {
+		err = s.db.Select(&hashes, fmt.Sprintf("SELECT hash FROM %s", s.objectsTable))
+	} else {
+		err = s.db.Select(&hashes, s.db.Rebind(fmt.Sprintf("SELECT hash FROM %s WHERE type = ?", s.objectsTable)), int8(t))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]plumbing.Hash, 0, len(hashes))
+	for _, h := range hashes {
+		series = append(series, plumbing.NewHash(h))
+	}
+
+	return storer.NewEncodedObjectLookupIter(s, t, series), nil
+}
+
+// HasEncodedObject returns plumbing.ErrObjectNotFound if there is no object
+// with the given hash
+func (s *Storage) HasEncodedObject(h plumbing.Hash) error {
+	_, err := s.EncodedObjectSize(h)
+
+	return err
+}
+
+// EncodedObjectSize returns the plaintext size of the object with the given
+// hash
+func (s *Storage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size := int64(0)
+
+	err := s.db.Get(&size, s.db.Rebind(fmt.Sprintf("SELECT size FROM %s WHERE hash = ?", s.objectsTable)), h.String())
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, plumbing.ErrObjectNotFound
+		}
+
+		return 0, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,139 @@
+package mysqlstorage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// referenceDB - db object for saving references
+type referenceDB struct {
+	Name   string `db:"name"`
+	Target string `db:"target"`
+}
+
+// SetReference saves the reference, replacing a stored one with the same
+// name
+func (s *Storage) SetReference(ref *plumbing.Reference) error {
+	if ref == nil {
+		return nil
+	}
+
+	return s.setReference(s.db, ref)
+}
+
+// CheckAndSetReference saves the reference new, but if old is not nil it
+// first checks that the stored value of the reference matches old. The check
+// and the update are done in one transaction.
+func (s *Storage) CheckAndSetReference(new, old *plumbing.Reference) error {
+	if new == nil {
+		return nil
+	}
+
+	tx, err := s.db.Beginx()
+
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		r := referenceDB{}
+		err = tx.Get(&r, tx.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE name = ?%s", s.refsTable, s.dialect.ForUpdate())), new.Name().String())
+
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+
+		if err == nil && plumbing.NewReferenceFromStrings(r.Name, r.Target).Hash() != old.Hash() {
+			tx.Rollback()
+			return storage.ErrReferenceHasChanged
+		}
+	}
+
+	err = s.setReference(tx, new)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) setReference(e sqlx.Execer, ref *plumbing.Reference) error {
+	v := ref.Strings()
+
+	_, err := e.Exec(
+		s.db.Rebind(s.dialect.Upsert(fmt.Sprintf("INSERT INTO %s(name, target) VALUES(?, ?)", s.refsTable), []string{"name"}, []string{"target"})),
+		v[0], v[1])
+
+	return err
+}
+
+// Reference returns the reference with the given name or
+// plumbing.ErrReferenceNotFound
+func (s *Storage) Reference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	r := referenceDB{}
+
+	err := s.db.Get(&r, s.db.Rebind(fmt.Sprintf("SELECT * FROM %s WHERE name = ?", s.refsTable)), n.String())
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, plumbing.ErrReferenceNotFound
+		}
+
+		return nil, err
+	}
+
+	return plumbing.NewReferenceFromStrings(r.Name, r.Target), nil
+}
+
+// IterReferences returns an iterator over all the stored references
+func (s *Storage) IterReferences() (storer.ReferenceIter, error) {
+	resDB := []referenceDB{}
+
+	err := s.db.Select(&resDB, fmt.Sprintf("SELECT * FROM %s ORDER BY name", s.refsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*plumbing.Reference, 0, len(resDB))
+	for _, r := range resDB {
+		refs = append(refs, plumbing.NewReferenceFromStrings(r.Name, r.Target))
+	}
+
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+// RemoveReference removes the reference with the given name. Removing a
+// missing reference is not an error.
+func (s *Storage) RemoveReference(n plumbing.ReferenceName) error {
+	_, err := s.db.Exec(s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE name = ?", s.refsTable)), n.String())
+
+	return err
+}
+
+// CountLooseRefs returns the number of stored references. There are no
+// packed references in db, so all of them are loose.
+func (s *Storage) CountLooseRefs() (int, error) {
+	count := 0
+
+	err := s.db.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s", s.refsTable))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// PackRefs is a no-op, references in db don't need packing
+func (s *Storage) PackRefs() error {
+	return nil
+}
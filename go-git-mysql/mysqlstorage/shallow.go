@@ -0,0 +1,52 @@
+package mysqlstorage
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// SetShallow replaces the list of shallow commits
+func (s *Storage) SetShallow(commits []plumbing.Hash) error {
+	tx, err := s.db.Beginx()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", s.shallowTable))
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, h := range commits {
+		_, err = tx.Exec(tx.Rebind(s.dialect.InsertIgnore(fmt.Sprintf("INSERT INTO %s(hash) VALUES(?)", s.shallowTable))), h.String())
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Shallow returns the list of shallow commits
+func (s *Storage) Shallow() ([]plumbing.Hash, error) {
+	hashes := []string{}
+
+	err := s.db.Select(&hashes, fmt.Sprintf("SELECT hash FROM %s", s.shallowTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var res []plumbing.Hash
+	for _, h := range hashes {
+		res = append(res, plumbing.NewHash(h))
+	}
+
+	return res, nil
+}
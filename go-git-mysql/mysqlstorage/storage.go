@@ -0,0 +1,152 @@
+// Package mysqlstorage provides a go-git storage.Storer based on mysql db
+package mysqlstorage
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/ujent/go-git-mysql/mysqlfs"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// Storage - realization of storage.Storer based on MySQL. Objects,
+// references, the index, config, shallow commits and MERGE_MSG are kept in
+// dedicated tables whose names start with the given prefix. The queries are
+// built with the dialect of mysqlfs, so PostgreSQL and SQLite work too.
+type Storage struct {
+	db      *sqlx.DB
+	dialect mysqlfs.Dialect
+	prefix  string
+
+	// the names of the tables are quoted
+	objectsTable string
+	refsTable    string
+	indexTable   string
+	configTable  string
+	shallowTable string
+	mergeTable   string
+}
+
+var _ storage.Storer = (*Storage)(nil)
+
+// NewStorage creates the tables (if they don't exist) and returns a Storage
+// working with them. The dialect is detected by the driver of db. The
+// prefix must be a valid table name of mysqlfs, otherwise
+// mysqlfs.ErrInvalidTableName is returned.
+func NewStorage(db *sql.DB, prefix string) (*Storage, error) {
+	return NewStorageWithDialect(db, prefix, mysqlfs.DetectDialect(db))
+}
+
+// NewStorageWithDialect is NewStorage with the given dialect, for drivers
+// which aren't detected
+func NewStorageWithDialect(db *sql.DB, prefix string, dialect mysqlfs.Dialect) (*Storage, error) {
+	if !mysqlfs.ValidTableName(prefix) {
+		return nil, mysqlfs.ErrInvalidTableName
+	}
+
+	s := &Storage{
+		db:           sqlx.NewDb(db, dialect.DriverName()),
+		dialect:      dialect,
+		prefix:       prefix,
+		objectsTable: dialect.Quote(prefix + "_objects"),
+		refsTable:    dialect.Quote(prefix + "_refs"),
+		indexTable:   dialect.Quote(prefix + "_index"),
+		configTable:  dialect.Quote(prefix + "_config"),
+		shallowTable: dialect.Quote(prefix + "_shallow"),
+		mergeTable:   dialect.Quote(prefix + "_merge"),
+	}
+
+	err := s.createTables()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Storage) createTables() error {
+	blob := s.dialect.BlobType()
+
+	var queries []string
+	queries = append(queries, s.dialect.CreateTable(s.prefix+"_objects",
+		[]string{
+			"hash CHAR(40) NOT NULL PRIMARY KEY",
+			"type SMALLINT NOT NULL",
+			"size BIGINT NOT NULL",
+			"content " + blob,
+		},
+		[][]string{{"type"}})...)
+	queries = append(queries, s.dialect.CreateTable(s.prefix+"_refs",
+		[]string{
+			"name varchar(255) NOT NULL PRIMARY KEY",
+			"target varchar(255) NOT NULL",
+		}, nil)...)
+
+	// index, config and MERGE_MSG are kept as single rows
+	for _, table := range []string{"_index", "_config", "_merge"} {
+		queries = append(queries, s.dialect.CreateTable(s.prefix+table,
+			[]string{
+				"id SMALLINT NOT NULL PRIMARY KEY",
+				"content " + blob,
+			}, nil)...)
+	}
+
+	queries = append(queries, s.dialect.CreateTable(s.prefix+"_shallow",
+		[]string{
+			"hash CHAR(40) NOT NULL PRIMARY KEY",
+		}, nil)...)
+
+	for _, q := range queries {
+		_, err := s.db.Exec(q)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Module returns a Storage representing a submodule. The prefix of its
+// tables is the hash of the prefix of s and the submodule name, so any name
+// is accepted and the prefix has the same length for every s.
+func (s *Storage) Module(name string) (storage.Storer, error) {
+	return NewStorageWithDialect(s.db.DB, fmt.Sprintf("m%x", sha1.Sum([]byte(s.prefix+"/"+name))), s.dialect)
+}
+
+// singleRowID - id of the only row of index, config and merge tables
+const singleRowID = 1
+
+func (s *Storage) getSingleRow(table string) ([]byte, error) {
+	var content []byte
+
+	err := s.db.Get(&content, s.db.Rebind(fmt.Sprintf("SELECT content FROM %s WHERE id = ?", table)), singleRowID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (s *Storage) setSingleRow(table string, content []byte) error {
+	_, err := s.db.Exec(
+		s.db.Rebind(s.dialect.Upsert(fmt.Sprintf("INSERT INTO %s(id, content) VALUES(?, ?)", table), []string{"id"}, []string{"content"})),
+		singleRowID, content)
+
+	return err
+}
+
+func (s *Storage) removeSingleRow(table string) error {
+	_, err := s.db.Exec(s.db.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", table)), singleRowID)
+
+	return err
+}
@@ -0,0 +1,436 @@
+package mysqlstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ujent/go-git-mysql/internal/testdb"
+	"github.com/ujent/go-git-mysql/mysqlfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+const prefix = "gitstorage"
+const worktreeTable = "gitworktree"
+
+// the tests run on an SQLite db in a temp file, see testdb for the dbs they
+// can run on
+var testDB = testdb.New("mysqlstorage_test.db")
+
+var testDriver, connStr = testDB.Driver, testDB.DSN
+
+func TestMain(m *testing.M) {
+	os.Exit(testDB.Run(m))
+}
+
+func createDB(connStr string) (*sql.DB, error) {
+	return testDB.Connect(connStr)
+}
+
+func TestObject(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello, go-git!"))
+	w.Close()
+
+	h, err := s.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h != obj.Hash() {
+		t.Errorf("Wrong hash. Must: %s, has: %s", obj.Hash(), h)
+	}
+
+	err = s.HasEncodedObject(h)
+	if err != nil {
+		t.Error(err)
+	}
+
+	size, err := s.EncodedObjectSize(h)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if size != obj.Size() {
+		t.Errorf("Wrong size. Must: %d, has: %d", obj.Size(), size)
+	}
+
+	got, err := s.EncodedObject(plumbing.BlobObject, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Hash() != h {
+		t.Errorf("Wrong hash. Must: %s, has: %s", h, got.Hash())
+	}
+
+	_, err = s.EncodedObject(plumbing.CommitObject, h)
+	if err != plumbing.ErrObjectNotFound {
+		t.Errorf("Wrong error. Must: %s, has: %v", plumbing.ErrObjectNotFound, err)
+	}
+
+	iter, err := s.IterEncodedObjects(plumbing.BlobObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = iter.ForEach(func(plumbing.EncodedObject) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if count != 1 {
+		t.Errorf("Wrong objects number. Must: 1, has: %d", count)
+	}
+}
+
+func TestInvalidPrefix(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"", "git storage", "git;DROP TABLE x"} {
+		_, err = NewStorage(db, p)
+		if err != mysqlfs.ErrInvalidTableName {
+			t.Errorf("Wrong error for prefix %q. Must: %s, has: %v", p, mysqlfs.ErrInvalidTableName, err)
+		}
+	}
+}
+
+func TestModule(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// modules of a storage with the longest prefix get valid prefixes too
+	long := strings.Repeat("g", 48)
+
+	s, err := NewStorage(db, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, long)
+
+	m1, err := s.Module("lib/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, m1.(*Storage).prefix)
+
+	m2, err := s.Module("lib/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := plumbing.NewHash("bc9968d75e48de59f0870ffb71f5e160bbbdcf52")
+
+	err = m1.SetReference(plumbing.NewHashReference("refs/heads/master", h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := m2.Reference("refs/heads/master")
+	if err != nil || ref.Hash() != h {
+		t.Errorf("Module has other tables: %v, %v", ref, err)
+	}
+
+	// modules of other storages don't share the tables
+	s1, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	m3, err := s1.Module("lib/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, m3.(*Storage).prefix)
+
+	if m3.(*Storage).prefix == m1.(*Storage).prefix {
+		t.Errorf("Modules of different storages have the same prefix %s", m1.(*Storage).prefix)
+	}
+}
+
+func TestReference(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	h1 := plumbing.NewHash("bc9968d75e48de59f0870ffb71f5e160bbbdcf52")
+	h2 := plumbing.NewHash("9a48f23120e880dfbe41f7c9b7b708e9ee62a492")
+	ref := plumbing.NewHashReference("refs/heads/master", h1)
+
+	err = s.SetReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Reference(ref.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Hash() != h1 {
+		t.Errorf("Wrong hash. Must: %s, has: %s", h1, got.Hash())
+	}
+
+	err = s.CheckAndSetReference(plumbing.NewHashReference(ref.Name(), h2), plumbing.NewHashReference(ref.Name(), h2))
+	if err != storage.ErrReferenceHasChanged {
+		t.Errorf("Wrong error. Must: %s, has: %v", storage.ErrReferenceHasChanged, err)
+	}
+
+	err = s.CheckAndSetReference(plumbing.NewHashReference(ref.Name(), h2), ref)
+	if err != nil {
+		t.Error(err)
+	}
+
+	count, err := s.CountLooseRefs()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if count != 2 {
+		t.Errorf("Wrong references number. Must: 2, has: %d", count)
+	}
+
+	err = s.RemoveReference(ref.Name())
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = s.Reference(ref.Name())
+	if err != plumbing.ErrReferenceNotFound {
+		t.Errorf("Wrong error. Must: %s, has: %v", plumbing.ErrReferenceNotFound, err)
+	}
+}
+
+func TestIndexAndConfig(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	idx, err := s.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx.Entries = append(idx.Entries, &index.Entry{Name: "README.md", Hash: plumbing.NewHash("bc9968d75e48de59f0870ffb71f5e160bbbdcf52")})
+
+	err = s.SetIndex(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = s.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(idx.Entries) != 1 {
+		t.Errorf("Wrong entries number. Must: 1, has: %d", len(idx.Entries))
+	}
+
+	cfg, err := s.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Remotes["origin"] = &config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/src-d/go-git"}}
+
+	err = s.SetConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = s.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cfg.Remotes["origin"]; !ok {
+		t.Error("Remote wasn't saved")
+	}
+}
+
+func TestShallowAndMergeMsg(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	commits := []plumbing.Hash{plumbing.NewHash("bc9968d75e48de59f0870ffb71f5e160bbbdcf52")}
+
+	err = s.SetShallow(commits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Shallow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 1 || res[0] != commits[0] {
+		t.Errorf("Wrong shallow commits. Must: %v, has: %v", commits, res)
+	}
+
+	err = s.SetMergeMsg("Merge branch 'topic'\n\n# Conflicts:\n#\tREADME.md\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := s.MergeMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != "Merge branch 'topic'" {
+		t.Errorf("Wrong message. Must: %s, has: %s", "Merge branch 'topic'", msg)
+	}
+
+	err = s.RemoveMergeMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = s.MergeMsgFileContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != "" {
+		t.Errorf("MERGE_MSG wasn't removed: %s", msg)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	db, err := createDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropTables(db, prefix)
+
+	fs, err := mysqlfs.New(db, worktreeTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropWorktree(db)
+
+	r, err := git.Init(s, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Create("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello, go-git!"))
+	f.Close()
+
+	_, err = wt.Add("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := wt.Commit("add README", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Jack Jonson",
+			Email: "JackJonson@gmail.com",
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = git.Open(s, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.Hash() != h {
+		t.Errorf("Wrong HEAD. Must: %s, has: %s", h, head.Hash())
+	}
+}
+
+func dropWorktree(db *sql.DB) {
+	mysqlfs.DropTables(db, worktreeTable)
+}
+
+func dropTables(db *sql.DB, prefix string) {
+	for _, suffix := range []string{"objects", "refs", "index", "config", "shallow", "merge"} {
+		db.Exec(fmt.Sprintf("DROP TABLE %s_%s", prefix, suffix))
+	}
+}